@@ -0,0 +1,195 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// AvatarSizes are the sizes of the stored thumbnails, the first one is the default
+var AvatarSizes = []int{128, 64, 32}
+
+// MaxAvatarBytes is the largest upload accepted
+const MaxAvatarBytes = 4 << 20
+
+// maxAvatarSide avoids decoding huge images from small files
+const maxAvatarSide = 4096
+
+var (
+	ErrAvatarFormat = errors.New("Avatar must be a PNG, JPEG or GIF")
+	ErrAvatarSize   = errors.New("Avatar is too large")
+)
+
+var avatarHash = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// AvatarStore keeps the avatars on disk, named by the hash of their content
+type AvatarStore struct {
+	dir string
+}
+
+// ValidAvatarHash check if hash could name an avatar
+func ValidAvatarHash(hash string) bool {
+	return avatarHash.MatchString(hash)
+}
+
+// Save decodes an uploaded image and stores it as square PNG thumbnails
+// Re-encoding drops any metadata of the upload
+func (s *AvatarStore) Save(r io.Reader) (hash string, err error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxAvatarBytes+1))
+	if err != nil {
+		return
+	}
+
+	if len(data) > MaxAvatarBytes {
+		return "", ErrAvatarSize
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", ErrAvatarFormat
+	}
+
+	switch format {
+	case "png", "jpeg", "gif":
+	default:
+		return "", ErrAvatarFormat
+	}
+
+	if config.Width > maxAvatarSide || config.Height > maxAvatarSide {
+		return "", ErrAvatarSize
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", ErrAvatarFormat
+	}
+
+	//Crop the center square
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(bounds.Min).Add(image.Pt((bounds.Dx()-side)/2, (bounds.Dy()-side)/2))
+
+	//Each size is made from the previous one
+	thumbs := make([][]byte, len(AvatarSizes))
+	for i, size := range AvatarSizes {
+		thumb := resize(img, crop, size)
+		img, crop = thumb, thumb.Bounds()
+
+		var buffer bytes.Buffer
+		if err = png.Encode(&buffer, thumb); err != nil {
+			return
+		}
+		thumbs[i] = buffer.Bytes()
+	}
+
+	sum := sha256.Sum256(thumbs[0])
+	hash = hex.EncodeToString(sum[:])
+	for i, size := range AvatarSizes {
+		if err = s.write(s.file(hash, size), thumbs[i]); err != nil {
+			return "", err
+		}
+	}
+	return
+}
+
+// Path returns the file of an avatar in size
+func (s *AvatarStore) Path(hash string, size int) (path string, ok bool) {
+	if !ValidAvatarHash(hash) {
+		return
+	}
+
+	path = s.file(hash, size)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+func (s *AvatarStore) file(hash string, size int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s-%d.png", hash, size))
+}
+
+// write is atomic, a reader never sees a partial file
+func (s *AvatarStore) write(path string, data []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, "upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// resize averages the pixels of rect in src into a size x size image
+func resize(src image.Image, rect image.Rectangle, size int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0 := rect.Min.Y + y*rect.Dy()/size
+		y1 := rect.Min.Y + (y+1)*rect.Dy()/size
+		if y1 == y0 {
+			y1++
+		}
+
+		for x := 0; x < size; x++ {
+			x0 := rect.Min.X + x*rect.Dx()/size
+			x1 := rect.Min.X + (x+1)*rect.Dx()/size
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// NewAvatarStore create a store in dir
+func NewAvatarStore(dir string) (*AvatarStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &AvatarStore{
+		dir: dir,
+	}, nil
+}
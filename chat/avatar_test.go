@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAvatarStoreSave(t *testing.T) {
+	store, err := NewAvatarStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for x := 0; x < 300; x++ {
+		img.Set(x, 100, color.RGBA{R: 255, A: 255})
+	}
+
+	var upload bytes.Buffer
+	if err = png.Encode(&upload, img); err != nil {
+		t.Fatal(err)
+	}
+	data := upload.Bytes()
+
+	hash, err := store.Save(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range AvatarSizes {
+		path, ok := store.Path(hash, size)
+		if !ok {
+			t.Fatalf("Missing avatar of size %d", size)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := png.DecodeConfig(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if config.Width != size || config.Height != size {
+			t.Fatalf("Expected %dx%d, got %dx%d", size, size, config.Width, config.Height)
+		}
+	}
+
+	//Same content, same hash
+	if again, err := store.Save(bytes.NewReader(data)); err != nil || again != hash {
+		t.Fatal("Avatar must be content-addressed")
+	}
+}
+
+func TestAvatarStoreInvalid(t *testing.T) {
+	store, err := NewAvatarStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = store.Save(strings.NewReader("Run Forrest, RUN!")); err != ErrAvatarFormat {
+		t.Fatal("Text must not be accepted as avatar")
+	}
+
+	if _, ok := store.Path("../../etc/passwd", 128); ok {
+		t.Fatal("Path must only accept hashes")
+	}
+}
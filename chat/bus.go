@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Topics of the bus
+const (
+	HubTopic         = "hub"
+	HubCloseTopic    = "hub.close"
+	HubPresenceTopic = "hub.presence"
+	RoomTopic        = "room"
+	RoomCloseTopic   = "room.close"
+)
+
+// BusMessage goes from a server instance to the others
+// Data is JSON, it is written as is to the connections
+type BusMessage struct {
+	Node  string    `rethinkdb:"node" json:"node"`
+	Topic string    `rethinkdb:"topic" json:"topic"`
+	Room  string    `rethinkdb:"room,omitempty" json:"room,omitempty"`
+	To    string    `rethinkdb:"to,omitempty" json:"to,omitempty"`
+	Data  string    `rethinkdb:"data" json:"data"`
+	Time  time.Time `rethinkdb:"time" json:"time"`
+}
+
+// Bus is a publish/subscribe channel between server instances
+// Every subscriber receives every message, also the ones it published
+type Bus interface {
+	Publish(message BusMessage) error
+	Subscribe(topic string, handler func(message BusMessage))
+}
+
+// NewBusMessage encodes data in a message of topic from node
+func NewBusMessage(node, topic, room, to string, data interface{}) (message BusMessage, err error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	return BusMessage{
+		Node:  node,
+		Topic: topic,
+		Room:  room,
+		To:    to,
+		Data:  string(encoded),
+		Time:  time.Now(),
+	}, nil
+}
+
+// busHandlers keeps the handlers of each topic
+type busHandlers struct {
+	handlers map[string][]func(message BusMessage)
+	m        *sync.RWMutex
+}
+
+func (b *busHandlers) Subscribe(topic string, handler func(message BusMessage)) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.handlers[topic] = append(b.handlers[topic], handler)
+}
+
+func (b *busHandlers) dispatch(message BusMessage) {
+	b.m.RLock()
+	handlers := b.handlers[message.Topic]
+	b.m.RUnlock()
+
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
+
+func newBusHandlers() busHandlers {
+	return busHandlers{
+		handlers: make(map[string][]func(message BusMessage)),
+		m:        &sync.RWMutex{},
+	}
+}
+
+// LocalBus delivers the messages inside the process, for a single instance
+type LocalBus struct {
+	busHandlers
+}
+
+// Publish calls the handlers before returning
+func (b *LocalBus) Publish(message BusMessage) error {
+	b.dispatch(message)
+	return nil
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{
+		busHandlers: newBusHandlers(),
+	}
+}
@@ -0,0 +1,200 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestLocalBus(t *testing.T) {
+	bus := NewLocalBus()
+
+	received := make([]BusMessage, 0)
+	bus.Subscribe(HubTopic, func(message BusMessage) {
+		received = append(received, message)
+	})
+
+	message, err := NewBusMessage("node", HubTopic, "", "forrest", "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus.Publish(message)
+
+	other, _ := NewBusMessage("node", RoomTopic, "room", "forrest", "run")
+	bus.Publish(other)
+
+	if len(received) != 1 || received[0].To != "forrest" || received[0].Data != `"run"` {
+		t.Fatalf("Wrong messages %v", received)
+	}
+}
+
+func TestHubBus(t *testing.T) {
+	bus := NewLocalBus()
+	first, second := NewHub(), NewHub()
+	first.SetBus(bus)
+	second.SetBus(bus)
+
+	local, remote := newFakePeer(), newFakePeer()
+	first.Add("forrest", local)
+	second.Add("jenny", remote)
+
+	if err := first.WriteTo(context.Background(), "invite", "room", "jenny"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case message := <-remote.messages:
+		data := make(map[string]interface{})
+		if err := json.Unmarshal(message.(json.RawMessage), &data); err != nil {
+			t.Fatal(err)
+		}
+		if data["event"] != "invite" || data["message"] != "room" {
+			t.Fatalf("Wrong event %v", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Event must reach the other hub")
+	}
+
+	//The own node must not deliver twice
+	select {
+	case <-local.messages:
+		t.Fatal("Event must not reach other users")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	first.Close("jenny", "Suspended")
+	select {
+	case reason := <-remote.closed:
+		if reason != "Suspended" {
+			t.Fatalf("Wrong reason %s", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close must reach the other hub")
+	}
+}
+
+func TestHubBusPresence(t *testing.T) {
+	bus := NewLocalBus()
+	first, second := NewHub(), NewHub()
+	first.SetBus(bus)
+	second.SetBus(bus)
+
+	changes := make(chan string, 8)
+	first.OnPresence(func(userID, presence string) {
+		changes <- "first:" + userID + ":" + presence
+	})
+	second.OnPresence(func(userID, presence string) {
+		changes <- "second:" + userID + ":" + presence
+	})
+
+	expect := func(expected string) {
+		select {
+		case change := <-changes:
+			if change != expected {
+				t.Fatalf("Expected change %s, got %s", expected, change)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Missing change %s", expected)
+		}
+	}
+
+	//The presence of the other hub arrives from the bus
+	waitRemote := func(hub *Hub, userID string, connected bool) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			hub.m.RLock()
+			_, ok := hub.remote[userID]
+			hub.m.RUnlock()
+			if ok == connected {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatal("Presence must reach the other hub")
+	}
+
+	local, remote := newFakePeer(), newFakePeer()
+	first.Add("forrest", local)
+	expect("first:forrest:online")
+	waitRemote(second, "forrest", true)
+	if second.Presence("forrest") != PresenceOnline {
+		t.Fatal("User must be online in the other hub")
+	}
+
+	//Connected to both, leaving one keeps the user online
+	second.Add("forrest", remote)
+	waitRemote(first, "forrest", true)
+	first.Rem("forrest", local)
+	if first.Presence("forrest") != PresenceOnline {
+		t.Fatal("User connected to the other hub must be online")
+	}
+	waitRemote(second, "forrest", false)
+
+	second.Rem("forrest", remote)
+	expect("second:forrest:offline")
+
+	select {
+	case change := <-changes:
+		t.Fatalf("Unexpected change %s", change)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestRoomBusOrder(t *testing.T) {
+	received := make(chan int, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+
+		for {
+			var n int
+			if err := wsjson.Read(context.Background(), conn, &n); err != nil {
+				return
+			}
+			received <- n
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	bus := NewLocalBus()
+	first, second := NewRoomManager(), NewRoomManager()
+	first.SetBus(bus)
+	second.SetBus(bus)
+	second.Store("room101").Store("jenny", conn)
+
+	//The signaling of another instance arrives in order
+	for i := 0; i < 50; i++ {
+		if err := first.WriteTo(context.Background(), "room101", "jenny", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		select {
+		case n := <-received:
+			if n != i {
+				t.Fatalf("Expected message %d, got %d", i, n)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Missing message %d", i)
+		}
+	}
+}
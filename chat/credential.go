@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidKey is returned when a secret key is not in the "keyID.secret" form
+var ErrInvalidKey = errors.New("Invalid secret key")
+
+// RandomHex returns n random bytes encoded as hex
+func RandomHex(n int) string {
+	val := make([]byte, n)
+	rand.Read(val)
+	return hex.EncodeToString(val)
+}
+
+// NewSecretKey generates a key ID and a secret
+// The key given to the user is "keyID.secret", only the key ID is stored in clear
+func NewSecretKey() (keyID, secret, key string) {
+	keyID = RandomHex(8)
+	secret = RandomHex(32)
+	key = keyID + "." + secret
+	return
+}
+
+// ParseSecretKey splits a key given by the user into key ID and secret
+func ParseSecretKey(key string) (keyID, secret string, err error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		err = ErrInvalidKey
+		return
+	}
+	return parts[0], parts[1], nil
+}
+
+// LegacyKeyID returns the key ID of a key given before "keyID.secret", the whole key is the secret
+func LegacyKeyID(key string) string {
+	return EncodeToSha(key)[:16]
+}
+
+// HashSecret returns a slow hash of secret to be stored
+func HashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// CompareSecret check in constant time if secret matches the stored hash
+func CompareSecret(hash, secret string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+}
+
+// NewRecoveryCodes generates n one-time codes to recover an account
+func NewRecoveryCodes(n int) (codes []string) {
+	codes = make([]string, n)
+	for i := range codes {
+		code := RandomHex(5)
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return
+}
+
+// HashRecoveryCodes returns the hashes of codes in the same order
+func HashRecoveryCodes(codes []string) (hashes []string, err error) {
+	hashes = make([]string, len(codes))
+	for i, code := range codes {
+		if hashes[i], err = HashSecret(code); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// MatchRecoveryCode returns the index of the hash that matches code, or -1
+func MatchRecoveryCode(hashes []string, code string) int {
+	for i, hash := range hashes {
+		if CompareSecret(hash, code) {
+			return i
+		}
+	}
+	return -1
+}
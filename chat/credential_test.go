@@ -0,0 +1,66 @@
+package chat
+
+import (
+	"testing"
+)
+
+func TestSecretKey(t *testing.T) {
+	keyID, secret, key := NewSecretKey()
+
+	parsedID, parsedSecret, err := ParseSecretKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsedID != keyID || parsedSecret != secret {
+		t.Fatal("Error to parse secret key")
+	}
+
+	hash, err := HashSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !CompareSecret(hash, secret) {
+		t.Fatal("Secret must match its hash")
+	}
+
+	if CompareSecret(hash, secret+"0") {
+		t.Fatal("Wrong secret must not match")
+	}
+}
+
+func TestParseSecretKeyInvalid(t *testing.T) {
+	for _, key := range []string{"", "abc", ".abc", "abc."} {
+		if _, _, err := ParseSecretKey(key); err != ErrInvalidKey {
+			t.Fatalf("Key '%s' must be invalid", key)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes := NewRecoveryCodes(3)
+	hashes, err := HashRecoveryCodes(codes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if MatchRecoveryCode(hashes, codes[2]) != 2 {
+		t.Fatal("Error to match recovery code")
+	}
+
+	if MatchRecoveryCode(hashes, "00000-00000") != -1 {
+		t.Fatal("Unknown code must not match")
+	}
+}
+
+func TestLegacyKeyID(t *testing.T) {
+	key := EncodeToSha("forrest")
+	if LegacyKeyID(key) != LegacyKeyID(key) || len(LegacyKeyID(key)) != 16 {
+		t.Fatal("Legacy key ID must be stable")
+	}
+
+	if LegacyKeyID(key) == LegacyKeyID(EncodeToSha("gump")) {
+		t.Fatal("Legacy keys must have different IDs")
+	}
+}
@@ -0,0 +1,15 @@
+package chat
+
+// FriendRequest is a pending request to be friends
+// Its ID is made from both users, so there is only one request between them
+type FriendRequest struct {
+	ID      string `rethinkdb:"id" json:"id"`
+	From    string `rethinkdb:"from" json:"from"`
+	To      string `rethinkdb:"to" json:"to"`
+	Created string `rethinkdb:"created" json:"created"`
+}
+
+// FriendRequestID returns the ID of the request from a user to another
+func FriendRequestID(from, to string) string {
+	return EncodeToSha(from + ":" + to)
+}
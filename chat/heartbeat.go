@@ -0,0 +1,30 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// Heartbeat pings conn every interval until ctx is done
+// It returns an error when a ping is not answered in timeout, the connection is dead
+// Pongs are only read while someone reads from conn
+func Heartbeat(ctx context.Context, conn *websocket.Conn, interval, timeout time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, timeout)
+			err := conn.Ping(pingCtx)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				return err
+			}
+		}
+	}
+}
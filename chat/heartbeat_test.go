@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// heartbeatServer runs Heartbeat on each connection and sends its result
+func heartbeatServer(ctx context.Context, result chan error) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close(websocket.StatusInternalError, "Connection closed")
+
+		readCtx := conn.CloseRead(ctx)
+		result <- Heartbeat(readCtx, conn, time.Millisecond*20, time.Millisecond*100)
+	}))
+}
+
+func dialHeartbeat(t *testing.T, server *httptest.Server) *websocket.Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestHeartbeatAlive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+
+	result := make(chan error, 1)
+	server := heartbeatServer(ctx, result)
+	defer server.Close()
+
+	//Reading answers the pings
+	conn := dialHeartbeat(t, server)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	conn.CloseRead(context.Background())
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Heartbeat must stop with the context")
+	}
+}
+
+func TestHeartbeatDead(t *testing.T) {
+	result := make(chan error, 1)
+	server := heartbeatServer(context.Background(), result)
+	defer server.Close()
+
+	//Not reading never answers the pings, the server closes the connection
+	dialHeartbeat(t, server)
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("Heartbeat must fail without pongs")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Heartbeat must detect the dead connection")
+	}
+}
@@ -2,59 +2,504 @@ package chat
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"log"
 	"sync"
+	"time"
+)
+
+// PeerQueueSize is how many events can wait for a slow peer before it is disconnected
+const PeerQueueSize = 64
+
+// peerWriteTimeout is how long a peer can take to receive an event
+const peerWriteTimeout = time.Second * 10
 
-	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
+// presenceRefresh is how often an instance sends the presence of its connections again,
+// an instance that stops for presenceTTL has its users forgotten
+const (
+	presenceRefresh = time.Second * 30
+	presenceTTL     = time.Second * 90
 )
 
+// hubPeer is a connection with its own queue, drained by a writer goroutine
+type hubPeer struct {
+	peer  Peer
+	queue chan interface{}
+	stop  chan struct{}
+	once  *sync.Once
+}
+
+func (p *hubPeer) close() {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+}
+
+// enqueue never blocks, it returns false when the queue is full
+func (hp *hubPeer) enqueue(message interface{}) bool {
+	select {
+	case hp.queue <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// presenceChange is queued with the lock held, so the callback receives the changes in order
+// Presence is of the local connections, empty if it came from another instance,
+// shared is of all the instances, empty if it did not change
+type presenceChange struct {
+	userID   string
+	presence string
+	shared   string
+}
+
+// presenceUpdate is sent to the other instances when the local presence of a user changes
+// Without announced the origin did not call its callback, so an instance whose shared presence changes does
+type presenceUpdate struct {
+	Presence  string `json:"presence"`
+	Announced bool   `json:"announced"`
+}
+
+// remotePresence is the presence of a user in another instance
+type remotePresence struct {
+	presence string
+	seen     time.Time
+}
+
+// Hub keeps the connections of each user, a user can be connected from many devices
+// Writes never block, each peer receives the events in its own goroutine
+// With a bus the events also reach the users connected to other instances,
+// and the presence is shared, a change is announced by the instance where it happened
 type Hub struct {
-	peers map[string]*websocket.Conn
-	m     *sync.RWMutex
+	peers      map[string]map[Peer]*hubPeer
+	presence   map[string]string
+	remote     map[string]map[string]remotePresence
+	onPresence func(userID, presence string)
+	changes    []presenceChange
+	changesM   *sync.Mutex
+	wake       chan struct{}
+	node       string
+	bus        Bus
+	m          *sync.RWMutex
 }
 
-func (h *Hub) Add(userID string, conn *websocket.Conn) {
+// Add a connection of a user, the first one makes the user online
+func (h *Hub) Add(userID string, peer Peer) {
+	h.AddFlush(userID, peer, nil)
+}
+
+// AddFlush adds a connection that first receives what flush writes, like a backlog
+// Flush runs in the writer of the peer, the events meanwhile wait in its queue
+// A flush error disconnects the peer
+func (h *Hub) AddFlush(userID string, peer Peer, flush func() error) {
+	hp := &hubPeer{
+		peer:  peer,
+		queue: make(chan interface{}, PeerQueueSize),
+		stop:  make(chan struct{}),
+		once:  &sync.Once{},
+	}
+
+	h.m.Lock()
+	if _, ok := h.peers[userID]; !ok {
+		h.peers[userID] = make(map[Peer]*hubPeer)
+		h.setPresence(userID, PresenceOnline)
+	}
+	if old, ok := h.peers[userID][peer]; ok {
+		old.close()
+	}
+	h.peers[userID][peer] = hp
+	h.m.Unlock()
+
+	go h.writer(userID, hp, flush)
+}
+
+// Rem a connection of a user, the last one makes the user offline
+func (h *Hub) Rem(userID string, peer Peer) {
+	h.remove(userID, peer, nil)
+}
+
+// Close disconnects every connection of a user from the hub
+func (h *Hub) Close(userID string, reason string) {
+	h.publish(HubCloseTopic, userID, reason)
+	h.close(userID, reason)
+}
+
+func (h *Hub) close(userID string, reason string) {
+	h.m.Lock()
+	conns, ok := h.peers[userID]
+	delete(h.peers, userID)
+	if ok {
+		h.setPresence(userID, PresenceOffline)
+	}
+	h.m.Unlock()
+
+	for _, hp := range conns {
+		hp.close()
+		hp.peer.Close(reason)
+	}
+}
+
+// Presence returns the presence of a user, offline if not connected to any instance
+func (h *Hub) Presence(userID string) string {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	return h.shared(userID)
+}
+
+// shared must be called with the lock held, the most available presence among the instances wins
+func (h *Hub) shared(userID string) string {
+	var presence string = PresenceOffline
+	if val, ok := h.presence[userID]; ok {
+		presence = val
+	}
+
+	for _, remote := range h.remote[userID] {
+		if time.Since(remote.seen) < presenceTTL && presenceRank[remote.presence] < presenceRank[presence] {
+			presence = remote.presence
+		}
+	}
+	return presence
+}
+
+// SetStatus changes the presence of a connected user
+func (h *Hub) SetStatus(userID, presence string) error {
+	if !ValidStatus(presence) {
+		return errors.New("Status not valid")
+	}
+
 	h.m.Lock()
 	defer h.m.Unlock()
-	h.peers[userID] = conn
+	if _, ok := h.peers[userID]; !ok {
+		return errors.New("Peer not found")
+	}
+	h.setPresence(userID, presence)
+	return nil
 }
 
-func (h *Hub) Rem(userID string) {
+// OnPresence sets a callback called when the presence of a user changes
+// It is called in order from a single goroutine, it can use the hub
+func (h *Hub) OnPresence(callback func(userID, presence string)) {
 	h.m.Lock()
 	defer h.m.Unlock()
-	if _, ok := h.peers[userID]; ok {
-		delete(h.peers, userID)
+	h.onPresence = callback
+}
+
+// setPresence must be called with the lock held, a change is queued to the callback
+func (h *Hub) setPresence(userID, presence string) {
+	var current string = PresenceOffline
+	if val, ok := h.presence[userID]; ok {
+		current = val
+	}
+	before := h.shared(userID)
+
+	if presence == PresenceOffline {
+		delete(h.presence, userID)
+	} else {
+		h.presence[userID] = presence
+	}
+
+	if current == presence {
+		return
+	}
+
+	change := presenceChange{userID: userID, presence: presence}
+	if after := h.shared(userID); after != before {
+		change.shared = after
 	}
+	h.queueChange(change)
 }
 
-func (h *Hub) WriteTo(ctx context.Context, event string, message interface{}, to string) (err error) {
+// queueChange must be called with the lock held
+func (h *Hub) queueChange(change presenceChange) {
+	h.changesM.Lock()
+	h.changes = append(h.changes, change)
+	h.changesM.Unlock()
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// notifyPresence sends the queued changes to the other instances and
+// calls the callback with the ones that changed the shared presence, out of the lock
+func (h *Hub) notifyPresence() {
+	for range h.wake {
+		h.changesM.Lock()
+		changes := h.changes
+		h.changes = nil
+		h.changesM.Unlock()
+
+		h.m.RLock()
+		callback := h.onPresence
+		h.m.RUnlock()
+
+		for _, change := range changes {
+			if len(change.presence) > 0 {
+				h.publish(HubPresenceTopic, change.userID, presenceUpdate{change.presence, len(change.shared) > 0})
+			}
+			if callback != nil && len(change.shared) > 0 {
+				callback(change.userID, change.shared)
+			}
+		}
+	}
+}
+
+// remove a connection if it is still hp, a nil hp removes any
+func (h *Hub) remove(userID string, peer Peer, hp *hubPeer) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	conns := h.peers[userID]
+	current, ok := conns[peer]
+	if ok && (hp == nil || hp == current) {
+		current.close()
+		delete(conns, peer)
+		if len(conns) == 0 {
+			delete(h.peers, userID)
+			h.setPresence(userID, PresenceOffline)
+		}
+	}
+}
+
+// drop disconnects a peer that failed or is too slow
+func (h *Hub) drop(userID string, hp *hubPeer, reason string) {
+	h.remove(userID, hp.peer, hp)
+	hp.close()
+	hp.peer.Close(reason)
+}
+
+func (h *Hub) writer(userID string, hp *hubPeer, flush func() error) {
+	if flush != nil {
+		if err := flush(); err != nil {
+			log.Println(err)
+			h.drop(userID, hp, "Flush failed")
+			return
+		}
+	}
+
+	for {
+		select {
+		case message := <-hp.queue:
+			ctx, cancel := context.WithTimeout(context.Background(), peerWriteTimeout)
+			err := hp.peer.Write(ctx, message)
+			cancel()
+			if err != nil {
+				h.drop(userID, hp, "Write failed")
+				return
+			}
+		case <-hp.stop:
+			return
+		}
+	}
+}
+
+// WriteTo queues an event to every connection of a user
+// With a bus the user can be in another instance, so it never fails
+func (h *Hub) WriteTo(ctx context.Context, event string, message interface{}, to string) error {
+	data := map[string]interface{}{
+		"event":   event,
+		"message": message,
+	}
+
+	err := h.queue(to, data)
+	if h.publish(HubTopic, to, data) {
+		return nil
+	}
+	return err
+}
+
+// Deliver queues a notification to every connection of its user
+func (h *Hub) Deliver(n Notification) error {
+	err := h.queue(n.UserID, n)
+	if h.publish(HubTopic, n.UserID, n) {
+		return nil
+	}
+	return err
+}
+
+// SetBus connects the hub to the other instances
+func (h *Hub) SetBus(bus Bus) {
+	h.m.Lock()
+	h.bus = bus
+	h.m.Unlock()
+
+	bus.Subscribe(HubTopic, h.receive)
+	bus.Subscribe(HubCloseTopic, h.receive)
+	bus.Subscribe(HubPresenceTopic, h.receive)
+	go h.refreshPresence()
+}
+
+// refreshPresence sends the presence of all the local connections and forgets the remote ones not refreshed
+func (h *Hub) refreshPresence() {
+	for range time.Tick(presenceRefresh) {
+		h.m.RLock()
+		presence := make(map[string]string, len(h.presence))
+		for userID, val := range h.presence {
+			presence[userID] = val
+		}
+		h.m.RUnlock()
+
+		if len(presence) > 0 {
+			h.publish(HubPresenceTopic, "", presence)
+		}
+
+		h.m.Lock()
+		for userID, nodes := range h.remote {
+			for node, remote := range nodes {
+				if time.Since(remote.seen) >= presenceTTL {
+					delete(nodes, node)
+				}
+			}
+			if len(nodes) == 0 {
+				delete(h.remote, userID)
+			}
+		}
+		h.m.Unlock()
+	}
+}
+
+// setRemote keeps the presence of a user in another instance
+// A change not announced by its origin is announced if it changes the shared presence here,
+// like when the user leaves two instances at the same time
+func (h *Hub) setRemote(node, userID, presence string, announced bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	before := h.shared(userID)
+
+	if presence == PresenceOffline {
+		delete(h.remote[userID], node)
+		if len(h.remote[userID]) == 0 {
+			delete(h.remote, userID)
+		}
+	} else {
+		if _, ok := h.remote[userID]; !ok {
+			h.remote[userID] = make(map[string]remotePresence)
+		}
+		h.remote[userID][node] = remotePresence{presence, time.Now()}
+	}
+
+	if after := h.shared(userID); !announced && after != before {
+		h.queueChange(presenceChange{userID: userID, shared: after})
+	}
+}
+
+// publish sends data to the other instances, it returns false without a bus
+func (h *Hub) publish(topic, to string, data interface{}) bool {
 	h.m.RLock()
-	defer h.m.RUnlock()
-	if peer, ok := h.peers[to]; ok {
-		err = wsjson.Write(ctx, peer, map[string]interface{}{
-			"event":   event,
-			"message": message,
-		})
+	bus := h.bus
+	h.m.RUnlock()
+
+	if bus == nil {
+		return false
+	}
+
+	message, err := NewBusMessage(h.node, topic, "", to, data)
+	if err == nil {
+		err = bus.Publish(message)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+// receive handles the messages of the other instances, it must not block
+func (h *Hub) receive(message BusMessage) {
+	if message.Node == h.node {
 		return
 	}
-	return errors.New("Peer not found")
+
+	switch message.Topic {
+	case HubTopic:
+		data := json.RawMessage(message.Data)
+		if len(message.To) > 0 {
+			h.queue(message.To, data)
+		} else {
+			h.write(data)
+		}
+	case HubCloseTopic:
+		var reason string
+		json.Unmarshal([]byte(message.Data), &reason)
+		go h.close(message.To, reason)
+	case HubPresenceTopic:
+		//To is empty when all the presence of the instance is refreshed
+		if len(message.To) > 0 {
+			var update presenceUpdate
+			if err := json.Unmarshal([]byte(message.Data), &update); err == nil {
+				h.setRemote(message.Node, message.To, update.Presence, update.Announced)
+			}
+			return
+		}
+
+		presence := make(map[string]string)
+		json.Unmarshal([]byte(message.Data), &presence)
+		for userID, val := range presence {
+			h.setRemote(message.Node, userID, val, true)
+		}
+	}
+}
+
+func (h *Hub) queue(to string, data interface{}) error {
+	h.m.RLock()
+	conns, ok := h.peers[to]
+	slow := make([]*hubPeer, 0)
+	for _, hp := range conns {
+		if !hp.enqueue(data) {
+			slow = append(slow, hp)
+		}
+	}
+	h.m.RUnlock()
+
+	for _, hp := range slow {
+		go h.drop(to, hp, "Too slow")
+	}
+
+	if !ok {
+		return errors.New("Peer not found")
+	}
+	return nil
 }
 
+// Write queues an event to every connection
 func (h *Hub) Write(ctx context.Context, event string, message interface{}) {
+	data := map[string]interface{}{
+		"event":   event,
+		"message": message,
+	}
+
+	h.write(data)
+	h.publish(HubTopic, "", data)
+}
+
+func (h *Hub) write(data interface{}) {
 	h.m.RLock()
-	defer h.m.RUnlock()
-	for _, peer := range h.peers {
-		wsjson.Write(ctx, peer, map[string]interface{}{
-			"event":   event,
-			"message": message,
-		})
+	slow := make(map[*hubPeer]string)
+	for userID, conns := range h.peers {
+		for _, hp := range conns {
+			if !hp.enqueue(data) {
+				slow[hp] = userID
+			}
+		}
+	}
+	h.m.RUnlock()
+
+	for hp, userID := range slow {
+		go h.drop(userID, hp, "Too slow")
 	}
 }
 
 func NewHub() *Hub {
-	return &Hub{
-		m:     &sync.RWMutex{},
-		peers: make(map[string]*websocket.Conn),
+	h := &Hub{
+		m:        &sync.RWMutex{},
+		changesM: &sync.Mutex{},
+		wake:     make(chan struct{}, 1),
+		node:     RandomHex(8),
+		peers:    make(map[string]map[Peer]*hubPeer),
+		presence: make(map[string]string),
+		remote:   make(map[string]map[string]remotePresence),
 	}
+	go h.notifyPresence()
+	return h
 }
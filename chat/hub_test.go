@@ -0,0 +1,236 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type fakePeer struct {
+	messages chan interface{}
+	block    chan struct{}
+	fail     bool
+	closed   chan string
+}
+
+func (p *fakePeer) Write(ctx context.Context, message interface{}) error {
+	if p.block != nil {
+		<-p.block
+	}
+	if p.fail {
+		return errors.New("Write failed")
+	}
+	if p.messages != nil {
+		p.messages <- message
+	}
+	return nil
+}
+
+func (p *fakePeer) Close(reason string) error {
+	p.closed <- reason
+	return nil
+}
+
+func newFakePeer() *fakePeer {
+	return &fakePeer{
+		messages: make(chan interface{}, PeerQueueSize),
+		closed:   make(chan string, 1),
+	}
+}
+
+func TestHubPresence(t *testing.T) {
+	hub := NewHub()
+
+	changes := make(chan string, 8)
+	hub.OnPresence(func(userID, presence string) {
+		changes <- userID + ":" + presence
+	})
+
+	if hub.Presence("forrest") != PresenceOffline {
+		t.Fatal("Not connected user must be offline")
+	}
+
+	if err := hub.SetStatus("forrest", PresenceAway); err == nil {
+		t.Fatal("Not connected user must not set status")
+	}
+
+	peer := newFakePeer()
+	hub.Add("forrest", peer)
+	if err := hub.SetStatus("forrest", PresenceAway); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hub.SetStatus("forrest", PresenceOffline); err == nil {
+		t.Fatal("Offline must not be set as status")
+	}
+
+	if hub.Presence("forrest") != PresenceAway {
+		t.Fatal("Error to set status")
+	}
+
+	hub.Rem("forrest", peer)
+	for _, expected := range []string{"forrest:online", "forrest:away", "forrest:offline"} {
+		select {
+		case change := <-changes:
+			if change != expected {
+				t.Fatalf("Expected change %s, got %s", expected, change)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Missing change %s", expected)
+		}
+	}
+
+	select {
+	case change := <-changes:
+		t.Fatalf("Unexpected change %s", change)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestHubConnections(t *testing.T) {
+	hub := NewHub()
+
+	first, second := newFakePeer(), newFakePeer()
+	hub.Add("forrest", first)
+	hub.Add("forrest", second)
+
+	if err := hub.WriteTo(context.Background(), "invite", "room", "forrest"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, peer := range []*fakePeer{first, second} {
+		select {
+		case <-peer.messages:
+		case <-time.After(time.Second):
+			t.Fatal("Every connection must receive the event")
+		}
+	}
+
+	hub.Rem("forrest", first)
+	if hub.Presence("forrest") != PresenceOnline {
+		t.Fatal("User with a connection must be online")
+	}
+
+	//Removing twice must not remove the other connection
+	hub.Rem("forrest", first)
+	if hub.Presence("forrest") != PresenceOnline {
+		t.Fatal("User with a connection must be online")
+	}
+
+	hub.Rem("forrest", second)
+	if hub.Presence("forrest") != PresenceOffline {
+		t.Fatal("User without connections must be offline")
+	}
+
+	if err := hub.WriteTo(context.Background(), "invite", "room", "forrest"); err == nil {
+		t.Fatal("Write to offline user must fail")
+	}
+}
+
+func TestHubSlowPeer(t *testing.T) {
+	hub := NewHub()
+
+	slow, fast := newFakePeer(), newFakePeer()
+	slow.block = make(chan struct{})
+	defer close(slow.block)
+	hub.Add("forrest", slow)
+	hub.Add("jenny", fast)
+
+	//The writer holds one event, then the queue fills
+	for i := 0; i < PeerQueueSize+2; i++ {
+		hub.WriteTo(context.Background(), "message", i, "forrest")
+	}
+
+	select {
+	case <-slow.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Slow peer must be disconnected")
+	}
+
+	if hub.Presence("forrest") != PresenceOffline {
+		t.Fatal("Slow peer must be removed")
+	}
+
+	if hub.Presence("jenny") != PresenceOnline {
+		t.Fatal("Fast peer must be kept")
+	}
+}
+
+func TestHubWriteError(t *testing.T) {
+	hub := NewHub()
+
+	peer := newFakePeer()
+	peer.fail = true
+	hub.Add("forrest", peer)
+	hub.WriteTo(context.Background(), "invite", "room", "forrest")
+
+	select {
+	case <-peer.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Failed peer must be disconnected")
+	}
+
+	if hub.Presence("forrest") != PresenceOffline {
+		t.Fatal("Failed peer must be removed")
+	}
+}
+
+func BenchmarkHubWrite(b *testing.B) {
+	hub := NewHub()
+	for i := 0; i < 5000; i++ {
+		peer := newFakePeer()
+		peer.messages = nil
+		hub.Add(fmt.Sprintf("user-%d", i), peer)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hub.Write(context.Background(), "message", i)
+	}
+}
+
+func TestHubFlush(t *testing.T) {
+	hub := NewHub()
+
+	peer := newFakePeer()
+	flushed := make(chan struct{})
+	hub.AddFlush("forrest", peer, func() error {
+		//Live events wait for the backlog
+		hub.WriteTo(context.Background(), "invite", "room", "forrest")
+		peer.Write(context.Background(), NewNotification("forrest", 1, "invite", "backlog"))
+		close(flushed)
+		return nil
+	})
+
+	<-flushed
+	for _, expected := range []string{"backlog", "room"} {
+		select {
+		case message := <-peer.messages:
+			var got interface{}
+			switch m := message.(type) {
+			case Notification:
+				got = m.Message
+			case map[string]interface{}:
+				got = m["message"]
+			}
+			if got != expected {
+				t.Fatalf("Expected %s, got %v", expected, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Missing %s", expected)
+		}
+	}
+
+	failed := newFakePeer()
+	hub.AddFlush("jenny", failed, func() error {
+		return errors.New("Write failed")
+	})
+
+	select {
+	case <-failed.closed:
+	case <-time.After(time.Second):
+		t.Fatal("A failed flush must close the peer")
+	}
+}
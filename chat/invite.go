@@ -1,7 +1,38 @@
 package chat
 
+import "time"
+
+// Invite to join a room, it is kept until accepted, declined or expired
+// Times are in UTC, so they can be compared as text in the database
 type Invite struct {
-	From   string `rethinkdb:"from" json:"from"`
-	To     string `rethinkdb:"to" json:"to"`
-	RoomID string `rethinkdb:"roomID" json:"roomID"`
+	ID      string `rethinkdb:"id" json:"id"`
+	From    string `rethinkdb:"from" json:"from"`
+	To      string `rethinkdb:"to" json:"to"`
+	RoomID  string `rethinkdb:"roomID" json:"roomID"`
+	Created string `rethinkdb:"created" json:"created"`
+	Expires string `rethinkdb:"expires" json:"expires"`
+}
+
+// InviteID returns the ID of the invites of a user to a room
+// There is only one pending invite to a user for a room
+func InviteID(to, roomID string) string {
+	return EncodeToSha(to + ":" + roomID)
+}
+
+// NewInvite creates an invite that expires after ttl
+func NewInvite(from, to, roomID string, ttl time.Duration) Invite {
+	now := time.Now().UTC()
+	return Invite{
+		ID:      InviteID(to, roomID),
+		From:    from,
+		To:      to,
+		RoomID:  roomID,
+		Created: now.Format(time.RFC3339),
+		Expires: now.Add(ttl).Format(time.RFC3339),
+	}
+}
+
+// Expired check if the invite can not be accepted anymore
+func (i *Invite) Expired() bool {
+	return i.Expires <= UTCNow()
 }
@@ -0,0 +1,26 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInviteExpired(t *testing.T) {
+	invite := NewInvite("forrest", "jenny", "room", time.Hour)
+	if invite.Expired() {
+		t.Fatal("New invite must not be expired")
+	}
+
+	if invite.ID != NewInvite("bubba", "jenny", "room", time.Hour).ID {
+		t.Fatal("Invites to the same user and room must have the same ID")
+	}
+
+	if invite.ID == NewInvite("forrest", "jenny", "room2", time.Hour).ID {
+		t.Fatal("Invites to other rooms must have different IDs")
+	}
+
+	invite = NewInvite("forrest", "jenny", "room", -time.Second)
+	if !invite.Expired() {
+		t.Fatal("Old invite must be expired")
+	}
+}
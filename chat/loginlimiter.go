@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingTimeout frees the attempts never ended with Fail or Release
+const pendingTimeout = time.Second * 10
+
+type loginEntry struct {
+	failures int
+	pending  int
+	until    time.Time
+	last     time.Time
+}
+
+// LoginLimiter counts failed logins by key (remote IP, account...)
+// After too many failures the key is locked out, doubling the time on each new failure
+type LoginLimiter struct {
+	m        *sync.Mutex
+	attempts int
+	lockout  time.Duration
+	max      time.Duration
+	entries  map[string]*loginEntry
+}
+
+// Allow check if key can try to login now and reserves the attempt
+// Attempts in progress count as failures, so parallel guesses can not exceed the limit
+// The attempt must be ended with Fail, Release or Reset
+// Return how long it must wait if it cannot
+func (l *LoginLimiter) Allow(key string) (wait time.Duration, ok bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	entry, exists := l.entries[key]
+	if !exists {
+		entry = &loginEntry{}
+		l.entries[key] = entry
+	}
+
+	if wait = time.Until(entry.until); wait > 0 {
+		return wait, false
+	}
+
+	if time.Since(entry.last) > pendingTimeout {
+		entry.pending = 0
+	}
+
+	//After a lockout only one attempt at a time
+	remaining := l.attempts - entry.failures
+	if remaining < 1 {
+		remaining = 1
+	}
+	if entry.pending >= remaining {
+		return time.Second, false
+	}
+
+	entry.pending++
+	entry.last = time.Now()
+	return 0, true
+}
+
+// Release ends an attempt of key that did not fail
+func (l *LoginLimiter) Release(key string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if entry, exists := l.entries[key]; exists && entry.pending > 0 {
+		entry.pending--
+	}
+}
+
+// Fail records a failed login of key
+// Return the lockout duration if key is locked out now
+func (l *LoginLimiter) Fail(key string) (locked time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	entry, exists := l.entries[key]
+	if !exists {
+		entry = &loginEntry{}
+		l.entries[key] = entry
+	}
+	if entry.pending > 0 {
+		entry.pending--
+	}
+	entry.failures++
+	entry.last = time.Now()
+
+	if entry.failures < l.attempts {
+		return 0
+	}
+
+	locked = l.lockout
+	for i := l.attempts; i < entry.failures && locked < l.max; i++ {
+		locked *= 2
+	}
+	if locked > l.max {
+		locked = l.max
+	}
+	entry.until = entry.last.Add(locked)
+	return
+}
+
+// Reset forgets the failures of key, used after a successful login
+func (l *LoginLimiter) Reset(key string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	delete(l.entries, key)
+}
+
+// Prune forgets keys without failures for longer than age
+func (l *LoginLimiter) Prune(age time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for key, entry := range l.entries {
+		if time.Since(entry.last) > age && time.Now().After(entry.until) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// NewLoginLimiter create a limiter that locks out after attempts failures
+// The first lockout lasts lockout and never longer than max
+func NewLoginLimiter(attempts int, lockout, max time.Duration) *LoginLimiter {
+	return &LoginLimiter{
+		m:        &sync.Mutex{},
+		attempts: attempts,
+		lockout:  lockout,
+		max:      max,
+		entries:  make(map[string]*loginEntry),
+	}
+}
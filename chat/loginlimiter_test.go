@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLimiterLockout(t *testing.T) {
+	limiter := NewLoginLimiter(3, time.Minute, time.Minute*3)
+
+	for i := 0; i < 2; i++ {
+		if locked := limiter.Fail("ip:127.0.0.1"); locked != 0 {
+			t.Fatal("Locked out before the attempts limit")
+		}
+	}
+
+	if _, ok := limiter.Allow("ip:127.0.0.1"); !ok {
+		t.Fatal("Key must be allowed before the attempts limit")
+	}
+
+	//Lockout doubles on each failure, until the max
+	for _, expected := range []time.Duration{time.Minute, time.Minute * 2, time.Minute * 3, time.Minute * 3} {
+		if locked := limiter.Fail("ip:127.0.0.1"); locked != expected {
+			t.Fatalf("Expected lockout of %s, got %s", expected, locked)
+		}
+	}
+
+	if wait, ok := limiter.Allow("ip:127.0.0.1"); ok || wait <= 0 {
+		t.Fatal("Key must be locked out")
+	}
+
+	if _, ok := limiter.Allow("ip:127.0.0.2"); !ok {
+		t.Fatal("Other keys must not be locked out")
+	}
+
+	limiter.Reset("ip:127.0.0.1")
+	if _, ok := limiter.Allow("ip:127.0.0.1"); !ok {
+		t.Fatal("Key must be allowed after reset")
+	}
+}
+
+func TestLoginLimiterPrune(t *testing.T) {
+	limiter := NewLoginLimiter(1, time.Millisecond, time.Millisecond)
+	limiter.Fail("account:forrest")
+
+	time.Sleep(time.Millisecond * 5)
+	limiter.Prune(time.Millisecond)
+
+	if len(limiter.entries) != 0 {
+		t.Fatal("Old keys must be pruned")
+	}
+}
+
+func TestLoginLimiterParallel(t *testing.T) {
+	limiter := NewLoginLimiter(3, time.Minute, time.Minute*3)
+
+	//Attempts in progress count until they end
+	for i := 0; i < 3; i++ {
+		if _, ok := limiter.Allow("account:forrest"); !ok {
+			t.Fatal("Key must be allowed before the attempts limit")
+		}
+	}
+
+	if _, ok := limiter.Allow("account:forrest"); ok {
+		t.Fatal("Parallel attempts must not exceed the limit")
+	}
+
+	limiter.Release("account:forrest")
+	if _, ok := limiter.Allow("account:forrest"); !ok {
+		t.Fatal("Key must be allowed after a release")
+	}
+
+	for i := 0; i < 3; i++ {
+		limiter.Fail("account:forrest")
+	}
+
+	if _, ok := limiter.Allow("account:forrest"); ok {
+		t.Fatal("Key must be locked out")
+	}
+}
@@ -0,0 +1,26 @@
+package chat
+
+import "time"
+
+// Notification is a hub event kept until the user acknowledges it
+// Seq orders the notifications of a user, it is counted by the user in the database
+type Notification struct {
+	ID      string      `rethinkdb:"id" json:"id"`
+	UserID  string      `rethinkdb:"userID" json:"-"`
+	Seq     int64       `rethinkdb:"seq" json:"-"`
+	Event   string      `rethinkdb:"event" json:"event"`
+	Message interface{} `rethinkdb:"message" json:"message"`
+	Created string      `rethinkdb:"created" json:"created"`
+}
+
+// NewNotification creates the notification number seq of an event to a user
+func NewNotification(userID string, seq int64, event string, message interface{}) Notification {
+	return Notification{
+		ID:      RandomHex(16),
+		UserID:  userID,
+		Seq:     seq,
+		Event:   event,
+		Message: message,
+		Created: time.Now().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,31 @@
+package chat
+
+import (
+	"context"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Peer is a connection that receives the events of the hub
+type Peer interface {
+	Write(ctx context.Context, message interface{}) error
+	Close(reason string) error
+}
+
+type socketPeer struct {
+	conn *websocket.Conn
+}
+
+func (p socketPeer) Write(ctx context.Context, message interface{}) error {
+	return wsjson.Write(ctx, p.conn, message)
+}
+
+func (p socketPeer) Close(reason string) error {
+	return p.conn.Close(websocket.StatusPolicyViolation, reason)
+}
+
+// SocketPeer wraps a websocket, the same conn always gives the same peer
+func SocketPeer(conn *websocket.Conn) Peer {
+	return socketPeer{conn: conn}
+}
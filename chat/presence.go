@@ -0,0 +1,33 @@
+package chat
+
+import "sort"
+
+// Presence of a user, it comes from the hub connection
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// ValidStatus check if a user can set presence by itself
+// Offline comes only from disconnecting
+func ValidStatus(presence string) bool {
+	return presence == PresenceOnline || presence == PresenceAway
+}
+
+var presenceRank = map[string]int{
+	PresenceOnline:  0,
+	PresenceAway:    1,
+	PresenceOffline: 2,
+}
+
+// SortByPresence orders users online first, then by name
+func SortByPresence(users []User) {
+	sort.SliceStable(users, func(i, j int) bool {
+		a, b := presenceRank[users[i].Presence], presenceRank[users[j].Presence]
+		if a != b {
+			return a < b
+		}
+		return NameKey(users[i].Name) < NameKey(users[j].Name)
+	})
+}
@@ -0,0 +1,22 @@
+package chat
+
+import (
+	"testing"
+)
+
+func TestSortByPresence(t *testing.T) {
+	users := []User{
+		{Name: "jenny", Presence: PresenceOffline},
+		{Name: "Dan", Presence: PresenceAway},
+		{Name: "forrest", Presence: PresenceOnline},
+		{Name: "bubba", Presence: PresenceOffline},
+	}
+
+	SortByPresence(users)
+	expected := []string{"forrest", "Dan", "bubba", "jenny"}
+	for i, name := range expected {
+		if users[i].Name != name {
+			t.Fatalf("Expected %s at %d, got %s", name, i, users[i].Name)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"log"
+	"time"
+
+	re "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// RethinkBus shares the messages between instances with a changefeed of a table
+type RethinkBus struct {
+	busHandlers
+	session *re.Session
+	table   re.Term
+}
+
+// Publish inserts the message, every instance receives it from the changefeed
+func (b *RethinkBus) Publish(message BusMessage) error {
+	_, err := b.table.Insert(message, re.InsertOpts{Durability: "soft"}).RunWrite(b.session)
+	return err
+}
+
+// Prune removes the messages older than age, they were already delivered
+func (b *RethinkBus) Prune(age time.Duration) error {
+	return b.table.Filter(re.Row.Field("time").Lt(re.Now().Sub(age.Seconds()))).Delete().Exec(b.session)
+}
+
+// listen follows the changefeed, it starts again if the feed is lost
+func (b *RethinkBus) listen() {
+	for {
+		cursor, err := b.table.Changes().Run(b.session)
+		if err != nil {
+			log.Println(err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var change struct {
+			NewVal *BusMessage `rethinkdb:"new_val"`
+		}
+		for cursor.Next(&change) {
+			if change.NewVal != nil {
+				b.dispatch(*change.NewVal)
+			}
+			change.NewVal = nil
+		}
+
+		if err = cursor.Err(); err != nil {
+			log.Println(err)
+		}
+		cursor.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// NewRethinkBus starts to follow table, it must exist
+func NewRethinkBus(session *re.Session, table re.Term) *RethinkBus {
+	bus := &RethinkBus{
+		busHandlers: newBusHandlers(),
+		session:     session,
+		table:       table,
+	}
+	go bus.listen()
+	return bus
+}
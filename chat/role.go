@@ -0,0 +1,32 @@
+package chat
+
+// Roles of a user in the server, each one has the rights of the previous
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{
+	"":            0,
+	RoleUser:      0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+// ValidRole check if role exists
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok && len(role) > 0
+}
+
+// HasRole check if role has at least the rights of required
+func HasRole(role, required string) bool {
+	rank, ok := roleRanks[role]
+	return ok && rank >= roleRanks[required]
+}
+
+// Outranks check if role has more rights than other
+func Outranks(role, other string) bool {
+	return roleRanks[role] > roleRanks[other]
+}
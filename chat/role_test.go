@@ -0,0 +1,26 @@
+package chat
+
+import (
+	"testing"
+)
+
+func TestHasRole(t *testing.T) {
+	cases := []struct {
+		role     string
+		required string
+		expected bool
+	}{
+		{"", RoleUser, true},
+		{RoleUser, RoleModerator, false},
+		{RoleModerator, RoleModerator, true},
+		{RoleAdmin, RoleModerator, true},
+		{RoleModerator, RoleAdmin, false},
+		{"root", RoleUser, false},
+	}
+
+	for _, c := range cases {
+		if HasRole(c.role, c.required) != c.expected {
+			t.Fatalf("HasRole('%s', '%s') must be %v", c.role, c.required, c.expected)
+		}
+	}
+}
@@ -30,6 +30,17 @@ func (r *Room) Delete(userID string) {
 	delete(r.conns, userID)
 }
 
+// Remove deletes userID only if it is still connected by conn
+func (r *Room) Remove(userID string, conn *websocket.Conn) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if current, ok := r.conns[userID]; ok && current == conn {
+		delete(r.conns, userID)
+		return true
+	}
+	return false
+}
+
 func (r *Room) Range(rfunc func(userID string, conn *websocket.Conn)) {
 	r.m.RLock()
 	defer r.m.RUnlock()
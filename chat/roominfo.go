@@ -1,8 +1,99 @@
 package chat
 
+// Visibility of a room
+const (
+	RoomPublic  = "public"
+	RoomPrivate = "private"
+)
+
+// RoomInfo is a room stored in the database
+// Password is the hash of the room password, Locked tells if there is one
+// Owner, Admins and Members are kept, Peers are only the connected ones
 type RoomInfo struct {
-	ID       string   `rethinkdb:"id"`
-	Name     string   `rethinkdb:"name"`
-	Password string   `rethinkdb:"password"`
-	Peers    []string `rethinkdb:"peers"`
+	ID         string   `rethinkdb:"id"`
+	Name       string   `rethinkdb:"name"`
+	Password   string   `rethinkdb:"password,omitempty" json:"-"`
+	Locked     bool     `rethinkdb:"-"`
+	Visibility string   `rethinkdb:"visibility"`
+	Peers      []string `rethinkdb:"peers"`
+	Owner      string   `rethinkdb:"owner"`
+	Admins     []string `rethinkdb:"admins"`
+	Members    []string `rethinkdb:"members"`
+	Banned     []string `rethinkdb:"banned,omitempty"`
+	Muted      []string `rethinkdb:"muted,omitempty"`
+}
+
+// ValidVisibility check if visibility is known
+func ValidVisibility(visibility string) bool {
+	return visibility == RoomPublic || visibility == RoomPrivate
+}
+
+// IsAdmin check if userID is the owner or an admin of the room
+func (r *RoomInfo) IsAdmin(userID string) bool {
+	return r.Owner == userID || contains(r.Admins, userID)
+}
+
+// IsMember check if userID is the owner, an admin or a member of the room
+func (r *RoomInfo) IsMember(userID string) bool {
+	return r.IsAdmin(userID) || contains(r.Members, userID)
+}
+
+// InRoom check if userID is a member or is connected to the room
+func (r *RoomInfo) InRoom(userID string) bool {
+	return r.IsMember(userID) || r.IsConnected(userID)
+}
+
+// IsConnected check if userID has a peer in the room now
+func (r *RoomInfo) IsConnected(userID string) bool {
+	return contains(r.Peers, userID)
+}
+
+// IsBanned check if userID can not join the room anymore
+func (r *RoomInfo) IsBanned(userID string) bool {
+	return contains(r.Banned, userID)
+}
+
+// IsMuted check if the tracks of userID are disabled in the room
+func (r *RoomInfo) IsMuted(userID string) bool {
+	return contains(r.Muted, userID)
+}
+
+// CanJoin check if userID can see and join the room, private rooms are only for members
+func (r *RoomInfo) CanJoin(userID string) bool {
+	if r.IsBanned(userID) {
+		return false
+	}
+	return r.Visibility == RoomPublic || r.IsMember(userID)
+}
+
+// CanModerate check if actor can kick, ban or mute target
+// The owner moderates everyone, the admins moderate who is not admin
+func (r *RoomInfo) CanModerate(actor, target string) bool {
+	if actor == target || target == r.Owner {
+		return false
+	}
+	if actor == r.Owner {
+		return true
+	}
+	return contains(r.Admins, actor) && !contains(r.Admins, target)
+}
+
+// Public hides who is in the room to the ones that are not members
+func (r *RoomInfo) Public() RoomInfo {
+	return RoomInfo{
+		ID:         r.ID,
+		Name:       r.Name,
+		Locked:     len(r.Password) > 0,
+		Visibility: r.Visibility,
+		Owner:      r.Owner,
+	}
+}
+
+func contains(list []string, val string) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"testing"
+)
+
+func TestRoomInfoMembers(t *testing.T) {
+	room := RoomInfo{
+		Owner:   "forrest",
+		Admins:  []string{"dan"},
+		Members: []string{"jenny"},
+		Peers:   []string{"bubba"},
+	}
+
+	for _, userID := range []string{"forrest", "dan", "jenny"} {
+		if !room.IsMember(userID) || !room.InRoom(userID) {
+			t.Fatalf("%s must be a member", userID)
+		}
+	}
+
+	if !room.IsAdmin("forrest") || !room.IsAdmin("dan") || room.IsAdmin("jenny") {
+		t.Fatal("Only the owner and the admins are admins")
+	}
+
+	if room.IsMember("bubba") || !room.InRoom("bubba") || !room.IsConnected("bubba") {
+		t.Fatal("A connected peer is in the room, not a member")
+	}
+
+	if room.IsConnected("forrest") {
+		t.Fatal("A member is not connected without a peer")
+	}
+
+	if room.InRoom("mama") {
+		t.Fatal("Others are not in the room")
+	}
+}
+
+func TestRoomInfoVisibility(t *testing.T) {
+	room := RoomInfo{
+		Owner:      "forrest",
+		Members:    []string{"jenny"},
+		Password:   "hash",
+		Visibility: RoomPrivate,
+	}
+
+	if !room.CanJoin("jenny") || room.CanJoin("bubba") {
+		t.Fatal("Only members can join a private room")
+	}
+
+	room.Visibility = RoomPublic
+	if !room.CanJoin("bubba") {
+		t.Fatal("Anyone can join a public room")
+	}
+
+	public := room.Public()
+	if len(public.Members) > 0 || len(public.Password) > 0 || !public.Locked {
+		t.Fatal("Public info must hide the members and the password")
+	}
+
+	if ValidVisibility("") || !ValidVisibility(RoomPrivate) {
+		t.Fatal("Error to validate visibility")
+	}
+}
+
+func TestRoomInfoModeration(t *testing.T) {
+	room := RoomInfo{
+		Owner:      "forrest",
+		Admins:     []string{"dan", "jenny"},
+		Members:    []string{"bubba"},
+		Banned:     []string{"abbott"},
+		Visibility: RoomPublic,
+	}
+
+	cases := []struct {
+		actor, target string
+		allowed       bool
+	}{
+		{"forrest", "dan", true},
+		{"forrest", "bubba", true},
+		{"dan", "bubba", true},
+		{"dan", "jenny", false},
+		{"dan", "forrest", false},
+		{"bubba", "dan", false},
+		{"forrest", "forrest", false},
+	}
+
+	for _, c := range cases {
+		if room.CanModerate(c.actor, c.target) != c.allowed {
+			t.Fatalf("%s moderate %s must be %v", c.actor, c.target, c.allowed)
+		}
+	}
+
+	if room.CanJoin("abbott") {
+		t.Fatal("Banned user must not join a public room")
+	}
+}
@@ -0,0 +1,50 @@
+package chat
+
+import "time"
+
+// RoomLink is a shareable invite to a room
+// Only the hash of the token is stored, the token is shown once to the owner
+type RoomLink struct {
+	ID      string `rethinkdb:"id" json:"-"`
+	LinkID  string `rethinkdb:"linkID" json:"id"`
+	RoomID  string `rethinkdb:"roomID" json:"roomID"`
+	Creator string `rethinkdb:"creator" json:"creator"`
+	MaxUses int    `rethinkdb:"maxUses" json:"maxUses,omitempty"`
+	Uses    int    `rethinkdb:"uses" json:"uses"`
+	Created string `rethinkdb:"created" json:"created"`
+	Expires string `rethinkdb:"expires" json:"expires,omitempty"`
+	Token   string `rethinkdb:"-" json:"token,omitempty"`
+}
+
+// NewRoomLink creates a link to a room, zero maxUses or ttl means no limit
+func NewRoomLink(roomID, creator string, maxUses int, ttl time.Duration) RoomLink {
+	now := time.Now().UTC()
+	token := RandomHex(24)
+	link := RoomLink{
+		ID:      RoomLinkID(token),
+		LinkID:  RandomHex(8),
+		RoomID:  roomID,
+		Creator: creator,
+		MaxUses: maxUses,
+		Created: now.Format(time.RFC3339),
+		Token:   token,
+	}
+
+	if ttl != 0 {
+		link.Expires = now.Add(ttl).Format(time.RFC3339)
+	}
+	return link
+}
+
+// RoomLinkID returns the stored ID of a token
+func RoomLinkID(token string) string {
+	return EncodeToSha(token)
+}
+
+// Valid check if the link can still be used
+func (l *RoomLink) Valid() bool {
+	if len(l.Expires) > 0 && l.Expires <= UTCNow() {
+		return false
+	}
+	return l.MaxUses == 0 || l.Uses < l.MaxUses
+}
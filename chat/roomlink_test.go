@@ -0,0 +1,33 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoomLink(t *testing.T) {
+	link := NewRoomLink("room", "forrest", 2, time.Hour)
+	if link.ID != RoomLinkID(link.Token) || link.ID == link.Token {
+		t.Fatal("Only the hash of the token must be the ID")
+	}
+
+	if !link.Valid() {
+		t.Fatal("New link must be valid")
+	}
+
+	link.Uses = 2
+	if link.Valid() {
+		t.Fatal("Used link must not be valid")
+	}
+
+	link = NewRoomLink("room", "forrest", 0, -time.Second)
+	if link.Valid() {
+		t.Fatal("Expired link must not be valid")
+	}
+
+	link = NewRoomLink("room", "forrest", 0, 0)
+	link.Uses = 1000
+	if !link.Valid() || len(link.Expires) > 0 {
+		t.Fatal("Link without limits must be valid")
+	}
+}
@@ -1,10 +1,26 @@
 package chat
 
-import "sync"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
 
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// RoomManager keeps the rooms with local peers
+// With a bus the signaling also reaches the peers connected to other instances,
+// each local peer receives it in order from its own writer
 type RoomManager struct {
-	rooms map[string]*Room
-	m     *sync.RWMutex
+	rooms   map[string]*Room
+	node    string
+	bus     Bus
+	writers map[*websocket.Conn]chan json.RawMessage
+	wm      *sync.Mutex
+	m       *sync.RWMutex
 }
 
 func (rm *RoomManager) Store(roomID string) (room *Room) {
@@ -31,9 +47,185 @@ func (rm *RoomManager) Delete(roomID string) {
 	delete(rm.rooms, roomID)
 }
 
+// Close disconnects every peer of a room and removes it, in every instance
+func (rm *RoomManager) Close(roomID string, reason string) {
+	rm.publish(RoomCloseTopic, roomID, "", reason)
+	rm.close(roomID, reason)
+}
+
+func (rm *RoomManager) close(roomID string, reason string) {
+	rm.m.Lock()
+	room, ok := rm.rooms[roomID]
+	delete(rm.rooms, roomID)
+	rm.m.Unlock()
+
+	if !ok {
+		return
+	}
+	room.Range(func(userID string, conn *websocket.Conn) {
+		conn.Close(websocket.StatusPolicyViolation, reason)
+	})
+}
+
+// Kick disconnects a user from a room, in every instance
+func (rm *RoomManager) Kick(roomID, userID string, reason string) {
+	rm.publish(RoomCloseTopic, roomID, userID, reason)
+	rm.kick(roomID, userID, reason)
+}
+
+func (rm *RoomManager) kick(roomID, userID string, reason string) {
+	if room, ok := rm.Load(roomID); ok {
+		if conn, ok := room.Load(userID); ok {
+			conn.Close(websocket.StatusPolicyViolation, reason)
+		}
+	}
+}
+
+// Find returns the room where a user is connected
+func (rm *RoomManager) Find(userID string) (roomID string, ok bool) {
+	rm.m.RLock()
+	defer rm.m.RUnlock()
+	for id, room := range rm.rooms {
+		if _, ok = room.Load(userID); ok {
+			return id, true
+		}
+	}
+	return
+}
+
+// WriteTo sends message to a peer of a room, local or in another instance
+func (rm *RoomManager) WriteTo(ctx context.Context, roomID, userID string, message interface{}) error {
+	if room, ok := rm.Load(roomID); ok {
+		if conn, ok := room.Load(userID); ok {
+			return wsjson.Write(ctx, conn, message)
+		}
+	}
+
+	if rm.publish(RoomTopic, roomID, userID, message) {
+		return nil
+	}
+	return errors.New("Peer not found")
+}
+
+// Write sends message to every peer of a room
+func (rm *RoomManager) Write(ctx context.Context, roomID string, message interface{}) {
+	rm.write(ctx, roomID, message)
+	rm.publish(RoomTopic, roomID, "", message)
+}
+
+func (rm *RoomManager) write(ctx context.Context, roomID string, message interface{}) {
+	if room, ok := rm.Load(roomID); ok {
+		room.Range(func(userID string, conn *websocket.Conn) {
+			wsjson.Write(ctx, conn, message)
+		})
+	}
+}
+
+// SetBus connects the rooms to the other instances
+func (rm *RoomManager) SetBus(bus Bus) {
+	rm.m.Lock()
+	rm.bus = bus
+	rm.m.Unlock()
+
+	bus.Subscribe(RoomTopic, rm.receive)
+	bus.Subscribe(RoomCloseTopic, rm.receive)
+}
+
+// publish sends data to the other instances, it returns false without a bus
+func (rm *RoomManager) publish(topic, roomID, to string, data interface{}) bool {
+	rm.m.RLock()
+	bus := rm.bus
+	rm.m.RUnlock()
+
+	if bus == nil {
+		return false
+	}
+
+	message, err := NewBusMessage(rm.node, topic, roomID, to, data)
+	if err == nil {
+		err = bus.Publish(message)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+// receive handles the messages of the other instances, writes are queued to not block the bus
+func (rm *RoomManager) receive(message BusMessage) {
+	if message.Node == rm.node {
+		return
+	}
+
+	switch message.Topic {
+	case RoomTopic:
+		room, ok := rm.Load(message.Room)
+		if !ok {
+			return
+		}
+
+		data := json.RawMessage(message.Data)
+		if len(message.To) == 0 {
+			room.Range(func(userID string, conn *websocket.Conn) {
+				rm.deliver(conn, data)
+			})
+		} else if conn, ok := room.Load(message.To); ok {
+			rm.deliver(conn, data)
+		}
+	case RoomCloseTopic:
+		var reason string
+		json.Unmarshal([]byte(message.Data), &reason)
+		if len(message.To) > 0 {
+			go rm.kick(message.Room, message.To, reason)
+		} else {
+			go rm.close(message.Room, reason)
+		}
+	}
+}
+
+// deliver queues data to a local peer, a peer too slow to keep up is disconnected
+func (rm *RoomManager) deliver(conn *websocket.Conn, data json.RawMessage) {
+	rm.wm.Lock()
+	defer rm.wm.Unlock()
+
+	queue, ok := rm.writers[conn]
+	if !ok {
+		queue = make(chan json.RawMessage, PeerQueueSize)
+		rm.writers[conn] = queue
+		go rm.writer(conn, queue)
+	}
+
+	select {
+	case queue <- data:
+	default:
+		go conn.Close(websocket.StatusPolicyViolation, "Too slow")
+	}
+}
+
+// writer ends when its queue is empty, the next deliver starts a new one
+func (rm *RoomManager) writer(conn *websocket.Conn, queue chan json.RawMessage) {
+	for {
+		rm.wm.Lock()
+		if len(queue) == 0 {
+			delete(rm.writers, conn)
+			rm.wm.Unlock()
+			return
+		}
+		data := <-queue
+		rm.wm.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), peerWriteTimeout)
+		wsjson.Write(ctx, conn, data)
+		cancel()
+	}
+}
+
 func NewRoomManager() *RoomManager {
 	return &RoomManager{
-		rooms: make(map[string]*Room),
-		m:     &sync.RWMutex{},
+		rooms:   make(map[string]*Room),
+		node:    RandomHex(8),
+		writers: make(map[*websocket.Conn]chan json.RawMessage),
+		wm:      &sync.Mutex{},
+		m:       &sync.RWMutex{},
 	}
 }
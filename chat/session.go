@@ -1,8 +1,51 @@
 package chat
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type Session struct {
 	Expire time.Time
 	UserID string
+	Role   string
+
+	//Only set for API tokens
+	TokenID string
+	Scopes  []string
+}
+
+// HasScope check if session can use scope, user sessions have all scopes
+func (s Session) HasScope(scope string) bool {
+	if len(s.TokenID) == 0 {
+		return true
+	}
+
+	for _, granted := range s.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey int
+
+const sessionKey contextKey = 0
+
+// WithSession returns a copy of ctx carrying session
+func WithSession(ctx context.Context, session Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// SessionFrom returns the session put in ctx by the Middleware
+func SessionFrom(ctx context.Context) (session Session, ok bool) {
+	session, ok = ctx.Value(sessionKey).(Session)
+	return
+}
+
+// UserIDFrom returns the authenticated user ID in ctx, empty if there is none
+func UserIDFrom(ctx context.Context) string {
+	session, _ := SessionFrom(ctx)
+	return session.UserID
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,49 +13,113 @@ type SessionManager struct {
 	m        *sync.RWMutex
 	ark      string
 	sessions map[string]Session
+	tickets  map[string]ticket
+	resolver func(token string) (Session, bool)
 }
 
 // Store a new Session
-func (sm *SessionManager) Store(expire time.Duration, userID string) (token string) {
+func (sm *SessionManager) Store(expire time.Duration, userID, role string) (token string) {
 	var future time.Time = time.Now().Add(expire)
 	token = EncodeToSha(sm.ark + userID)
 	sm.m.Lock()
 	sm.sessions[token] = Session{
 		Expire: future,
 		UserID: userID,
+		Role:   role,
 	}
 	sm.m.Unlock()
 	return
 }
 
+// Revoke removes all sessions and tickets of a user
+func (sm *SessionManager) Revoke(userID string) {
+	sm.m.Lock()
+	defer sm.m.Unlock()
+	for token, session := range sm.sessions {
+		if session.UserID == userID {
+			delete(sm.sessions, token)
+		}
+	}
+
+	for token, t := range sm.tickets {
+		if t.session.UserID == userID {
+			delete(sm.tickets, token)
+		}
+	}
+}
+
 // IsValid check if a token is valid
 // Return a
 func (sm *SessionManager) IsValid(token string) (auth Session, valid bool) {
-	sm.m.RLock()
+	sm.m.Lock()
 	if auth, valid = sm.sessions[token]; valid {
 		if valid = (auth.Expire.Sub(time.Now()) >= 0); !valid {
 			delete(sm.sessions, token)
 		}
 	}
-	sm.m.RUnlock()
+	sm.m.Unlock()
+	return
+}
+
+// authenticate checks a session token or an API token
+func (sm *SessionManager) authenticate(token string) (session Session, valid bool) {
+	if len(token) == 0 {
+		return
+	}
+
+	session, valid = sm.IsValid(token)
+	if !valid && sm.resolver != nil && strings.HasPrefix(token, TokenPrefix) {
+		session, valid = sm.resolver(token)
+	}
 	return
 }
 
 // Middleware is used to before restrict endpoint
+// The session is put in the request context, read it with SessionFrom
 func (sm *SessionManager) Middleware(sucess http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//Never trust an identity sent by the client
+		r.Header.Del("userID")
+
 		token := r.Header.Get("Authorization")
 		if len(token) == 0 {
 			w.WriteHeader(http.StatusNonAuthoritativeInfo)
 			return
 		}
 
-		session, valid := sm.IsValid(token)
+		session, valid := sm.authenticate(token)
 		if !valid {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		r.Header.Add("userID", session.UserID)
+		sucess.ServeHTTP(w, r.WithContext(WithSession(r.Context(), session)))
+	})
+}
+
+// Optional is used on endpoints that also work without a session
+// An invalid token is ignored, the request continues without session
+func (sm *SessionManager) Optional(sucess http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("userID")
+		if session, valid := sm.authenticate(r.Header.Get("Authorization")); valid {
+			r = r.WithContext(WithSession(r.Context(), session))
+		}
+		sucess.ServeHTTP(w, r)
+	})
+}
+
+// SetTokenResolver sets how API tokens are checked by the Middleware
+func (sm *SessionManager) SetTokenResolver(resolver func(token string) (Session, bool)) {
+	sm.resolver = resolver
+}
+
+// RequireRole is the Middleware for endpoints restricted to a role
+func (sm *SessionManager) RequireRole(role string, sucess http.HandlerFunc) http.HandlerFunc {
+	return sm.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		if session, _ := SessionFrom(r.Context()); !HasRole(session.Role, role) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 		sucess.ServeHTTP(w, r)
 	})
 }
@@ -67,6 +132,7 @@ func NewSessionManager() *SessionManager {
 	return &SessionManager{
 		ark:      hex.EncodeToString(val),
 		sessions: make(map[string]Session),
+		tickets:  make(map[string]ticket),
 		m:        &sync.RWMutex{},
 	}
 }
@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareSession(t *testing.T) {
+	sm := NewSessionManager()
+	token := sm.Store(time.Minute, "forrest", RoleUser)
+
+	var userID string
+	handler := sm.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("userID")) > 0 {
+			t.Fatal("userID header must be removed")
+		}
+		userID = UserIDFrom(r.Context())
+	})
+
+	req := httptest.NewRequest("GET", "/users/me", nil)
+	req.Header.Set("Authorization", token)
+	req.Header.Set("userID", "bubba")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if userID != "forrest" {
+		t.Fatalf("Expected user 'forrest', got '%s'", userID)
+	}
+}
+
+func TestMiddlewareUnauthorized(t *testing.T) {
+	sm := NewSessionManager()
+	handler := sm.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("Handler must not be called")
+	})
+
+	req := httptest.NewRequest("GET", "/users/me", nil)
+	req.Header.Set("Authorization", "invalid")
+	req.Header.Set("userID", "bubba")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestSocketMiddlewareTicket(t *testing.T) {
+	sm := NewSessionManager()
+	ticket := sm.Ticket(time.Minute, Session{UserID: "forrest"}, SocketTicket)
+
+	var userID string
+	handler := sm.SocketMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		userID = UserIDFrom(r.Context())
+	})
+
+	req := httptest.NewRequest("GET", "/hub/join", nil)
+	req.Header.Set("Sec-WebSocket-Protocol", "chat, "+TicketProtocolPrefix+ticket)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if userID != "forrest" {
+		t.Fatalf("Expected user 'forrest', got '%s'", userID)
+	}
+
+	//Tickets are single-use
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/hub/join?ticket="+ticket, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestRedeemTicketSubject(t *testing.T) {
+	sm := NewSessionManager()
+	ticket := sm.Ticket(time.Minute, Session{UserID: "forrest"}, "room")
+
+	if _, valid := sm.RedeemTicket(ticket, SocketTicket); valid {
+		t.Fatal("Ticket must only be valid for its subject")
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	sm := NewSessionManager()
+	handler := sm.RequireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for role, expected := range map[string]int{
+		RoleUser:      http.StatusForbidden,
+		RoleModerator: http.StatusForbidden,
+		RoleAdmin:     http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/admin/users", nil)
+		req.Header.Set("Authorization", sm.Store(time.Minute, role, role))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != expected {
+			t.Fatalf("Role '%s' expected status %d, got %d", role, expected, rec.Code)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	sm := NewSessionManager()
+	token := sm.Store(time.Minute, "forrest", RoleUser)
+	ticket := sm.Ticket(time.Minute, Session{UserID: "forrest"}, SocketTicket)
+
+	sm.Revoke("forrest")
+	if _, valid := sm.IsValid(token); valid {
+		t.Fatal("Session must be revoked")
+	}
+
+	if _, valid := sm.RedeemTicket(ticket, SocketTicket); valid {
+		t.Fatal("Ticket must be revoked")
+	}
+}
+
+func TestOptional(t *testing.T) {
+	sm := NewSessionManager()
+
+	var userID string
+	handler := sm.Optional(func(w http.ResponseWriter, r *http.Request) {
+		userID = UserIDFrom(r.Context())
+	})
+
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "invalid")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if len(userID) > 0 {
+		t.Fatal("Invalid token must not have a session")
+	}
+
+	req.Header.Set("Authorization", sm.Store(time.Minute, "forrest", RoleUser))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if userID != "forrest" {
+		t.Fatalf("Expected user 'forrest', got '%s'", userID)
+	}
+}
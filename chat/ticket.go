@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// SocketTicket is the subject of tickets used to open a WebSocket
+const SocketTicket = "ws"
+
+// TicketProtocolPrefix is the prefix of the subprotocol carrying a ticket
+const TicketProtocolPrefix = "ticket."
+
+// RoomTicket returns the subject of tickets used to join a locked room
+func RoomTicket(roomID string) string {
+	return "room:" + roomID
+}
+
+type ticket struct {
+	session Session
+	subject string
+	expire  time.Time
+}
+
+// Ticket issues a single-use ticket for session, only valid for subject
+func (sm *SessionManager) Ticket(expire time.Duration, session Session, subject string) (token string) {
+	token = RandomHex(32)
+	sm.m.Lock()
+	defer sm.m.Unlock()
+
+	//Forget the expired ones
+	for key, t := range sm.tickets {
+		if time.Now().After(t.expire) {
+			delete(sm.tickets, key)
+		}
+	}
+
+	sm.tickets[token] = ticket{
+		session: session,
+		subject: subject,
+		expire:  time.Now().Add(expire),
+	}
+	return
+}
+
+// RedeemTicket returns the session of a ticket and forgets it
+func (sm *SessionManager) RedeemTicket(token, subject string) (session Session, valid bool) {
+	sm.m.Lock()
+	defer sm.m.Unlock()
+	t, valid := sm.tickets[token]
+	if !valid {
+		return
+	}
+	delete(sm.tickets, token)
+
+	if t.subject != subject || time.Now().After(t.expire) {
+		return session, false
+	}
+	return t.session, true
+}
+
+// TicketProtocol returns the subprotocol carrying a ticket, empty if there is none
+func TicketProtocol(r *http.Request) string {
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); strings.HasPrefix(protocol, TicketProtocolPrefix) {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
+
+// AcceptOptions returns the options to accept a WebSocket authenticated by SocketMiddleware
+// Browsers close the socket if the server does not answer the ticket subprotocol
+func AcceptOptions(r *http.Request) *websocket.AcceptOptions {
+	if protocol := TicketProtocol(r); len(protocol) > 0 {
+		return &websocket.AcceptOptions{
+			Subprotocols: []string{protocol},
+		}
+	}
+	return nil
+}
+
+// SocketMiddleware is the Middleware for WebSockets
+// Browsers cannot set the Authorization header, so a ticket is also accepted
+// as the "ticket" query parameter or as a "ticket.<ticket>" subprotocol
+func (sm *SessionManager) SocketMiddleware(sucess http.HandlerFunc) http.HandlerFunc {
+	restricted := sm.Middleware(sucess)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("Authorization")) > 0 {
+			restricted.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del("userID")
+
+		token := r.URL.Query().Get("ticket")
+		if len(token) == 0 {
+			token = strings.TrimPrefix(TicketProtocol(r), TicketProtocolPrefix)
+		}
+
+		if len(token) == 0 {
+			w.WriteHeader(http.StatusNonAuthoritativeInfo)
+			return
+		}
+
+		session, valid := sm.RedeemTicket(token, SocketTicket)
+		if !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		sucess.ServeHTTP(w, r.WithContext(WithSession(r.Context(), session)))
+	})
+}
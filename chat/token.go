@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Scopes an API token can be granted
+const (
+	ScopeRoomsRead     = "rooms:read"
+	ScopeRoomsWrite    = "rooms:write"
+	ScopeMessagesWrite = "messages:write"
+	ScopeHubSubscribe  = "hub:subscribe"
+)
+
+// ScopeAccount is held by user sessions only, tokens cannot manage the account
+const ScopeAccount = "account"
+
+// TokenScopes are the scopes an API token can be granted
+var TokenScopes = []string{
+	ScopeRoomsRead,
+	ScopeRoomsWrite,
+	ScopeMessagesWrite,
+	ScopeHubSubscribe,
+}
+
+// TokenPrefix starts every API token, tokens are "tok.<id>.<secret>"
+const TokenPrefix = "tok."
+
+// Token is a long-lived API token for bots and integrations
+type Token struct {
+	ID       string   `rethinkdb:"id" json:"id"`
+	UserID   string   `rethinkdb:"userID" json:"-"`
+	Name     string   `rethinkdb:"name" json:"name"`
+	Scopes   []string `rethinkdb:"scopes" json:"scopes"`
+	Hash     string   `rethinkdb:"hash" json:"-"`
+	Created  string   `rethinkdb:"created" json:"created"`
+	LastUsed string   `rethinkdb:"lastUsed,omitempty" json:"lastUsed,omitempty"`
+}
+
+// NewToken generates an API token
+// The secret is random enough to be stored with EncodeToSha
+func NewToken() (id, secret, token string) {
+	id = RandomHex(8)
+	secret = RandomHex(32)
+	token = TokenPrefix + id + "." + secret
+	return
+}
+
+// ParseToken splits an API token into ID and secret
+func ParseToken(token string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(token, TokenPrefix) {
+		return
+	}
+	id, secret, err := ParseSecretKey(token[len(TokenPrefix):])
+	return id, secret, err == nil
+}
+
+// ValidScopes check if all scopes can be granted to a token
+func ValidScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+
+	for _, scope := range scopes {
+		valid := false
+		for _, allowed := range TokenScopes {
+			valid = valid || scope == allowed
+		}
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
+
+// RequireScope restricts an endpoint to sessions with scope
+// It must be used inside a Middleware
+func RequireScope(scope string, sucess http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if session, _ := SessionFrom(r.Context()); !session.HasScope(scope) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		sucess.ServeHTTP(w, r)
+	})
+}
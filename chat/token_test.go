@@ -0,0 +1,63 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseToken(t *testing.T) {
+	id, secret, token := NewToken()
+
+	parsedID, parsedSecret, ok := ParseToken(token)
+	if !ok || parsedID != id || parsedSecret != secret {
+		t.Fatal("Error to parse token")
+	}
+
+	if _, _, ok = ParseToken(id + "." + secret); ok {
+		t.Fatal("Token without prefix must be invalid")
+	}
+}
+
+func TestValidScopes(t *testing.T) {
+	if !ValidScopes([]string{ScopeRoomsRead, ScopeHubSubscribe}) {
+		t.Fatal("Scopes must be valid")
+	}
+
+	for _, scopes := range [][]string{nil, {ScopeAccount}, {ScopeRoomsRead, "rooms:delete"}} {
+		if ValidScopes(scopes) {
+			t.Fatalf("Scopes %v must be invalid", scopes)
+		}
+	}
+}
+
+func TestTokenResolver(t *testing.T) {
+	sm := NewSessionManager()
+	_, _, token := NewToken()
+	sm.SetTokenResolver(func(value string) (Session, bool) {
+		return Session{UserID: "bot", TokenID: "1", Scopes: []string{ScopeRoomsRead}}, value == token
+	})
+
+	handler := sm.Middleware(RequireScope(ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("POST", "/rooms", nil)
+	req.Header.Set("Authorization", token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	//User sessions have all scopes
+	req.Header.Set("Authorization", sm.Store(time.Minute, "forrest", RoleUser))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+}
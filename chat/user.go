@@ -1,13 +1,46 @@
 package chat
 
+import "strings"
+
 // User is a struct to know about user
 type User struct {
-	ID        string   `rethinkdb:"id,omitempty" json:"-"`
-	Name      string   `rethinkdb:"name" json:"name"`
-	UserID    string   `rethinkdb:"userID" json:"userID"`
-	SecretKey string   `rethinkdb:"secretKey" json:"secretKey,omitempty"`
-	Created   string   `rethinkdb:"created" json:"created"`
-	LastTime  string   `rethinkdb:"lasttime" json:"lastTime,omitempty"`
-	Invites   []Invite `rethinkdb:"invites" json:"invites,omitempty"`
-	Friends   []string `rethinkdb:"friends" json:"friends,omitempty"`
+	ID             string   `rethinkdb:"id,omitempty" json:"-"`
+	Name           string   `rethinkdb:"name" json:"name"`
+	NameKey        string   `rethinkdb:"nameKey" json:"-"`
+	UserID         string   `rethinkdb:"userID" json:"userID"`
+	SecretKey      string   `rethinkdb:"-" json:"secretKey,omitempty"`
+	KeyID          string   `rethinkdb:"keyID" json:"-"`
+	SecretHash     string   `rethinkdb:"secretHash" json:"-"`
+	Password       string   `rethinkdb:"-" json:"password,omitempty"`
+	PassHash       string   `rethinkdb:"passwordHash,omitempty" json:"-"`
+	Recovery       []string `rethinkdb:"-" json:"recoveryCodes,omitempty"`
+	RecoveryHashes []string `rethinkdb:"recoveryHashes,omitempty" json:"-"`
+	Created        string   `rethinkdb:"created" json:"created"`
+	LastTime       string   `rethinkdb:"lasttime" json:"lastTime,omitempty"`
+	Friends        []string `rethinkdb:"friends" json:"friends,omitempty"`
+	Blocked        []string `rethinkdb:"blocked,omitempty" json:"-"`
+	Status         string   `rethinkdb:"status,omitempty" json:"status,omitempty"`
+	Avatar         string   `rethinkdb:"avatar,omitempty" json:"avatar,omitempty"`
+	Role           string   `rethinkdb:"role,omitempty" json:"role,omitempty"`
+	Suspended      bool     `rethinkdb:"suspended,omitempty" json:"suspended,omitempty"`
+	ShareRoom      bool     `rethinkdb:"shareRoom,omitempty" json:"shareRoom,omitempty"`
+	Presence       string   `rethinkdb:"-" json:"presence,omitempty"`
+	Room           string   `rethinkdb:"-" json:"room,omitempty"`
+}
+
+// Public returns only the fields anyone can see
+func (u *User) Public() User {
+	return User{
+		Name:     u.Name,
+		UserID:   u.UserID,
+		Created:  u.Created,
+		LastTime: u.LastTime,
+		Status:   u.Status,
+		Avatar:   u.Avatar,
+	}
+}
+
+// NameKey returns the key of a name, names are unique without case
+func NameKey(name string) string {
+	return strings.ToLower(name)
 }
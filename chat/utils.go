@@ -3,9 +3,15 @@ package chat
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"time"
 )
 
 func EncodeToSha(str string) string {
 	buffer := sha256.Sum256([]byte(str))
 	return hex.EncodeToString(buffer[:])
 }
+
+// UTCNow returns the current time to compare as text with stored expiries
+func UTCNow() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
@@ -3,17 +3,23 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"nhooyr.io/websocket/wsjson"
 
@@ -74,559 +80,2986 @@ func setHeaderJSON(w http.ResponseWriter) {
 	w.Header().Set("Accept", "application/json")
 }
 
-func configDB(session *re.Session) {
-	if err := re.DBCreate("chat").Exec(session); err != nil {
-		return
-	}
+func configDB(session *re.Session, inviteTTL time.Duration) {
+	//Errors are ignored, they only mean it was already created
+	re.DBCreate("chat").Exec(session)
 	re.DB("chat").TableCreate("users").Exec(session)
 	re.DB("chat").TableCreate("rooms").Exec(session)
+	re.DB("chat").TableCreate("tokens").Exec(session)
+	re.DB("chat").TableCreate("usernames").Exec(session)
+	re.DB("chat").TableCreate("friendRequests").Exec(session)
+	re.DB("chat").TableCreate("notifications").Exec(session)
+	re.DB("chat").TableCreate("bus").Exec(session)
+	re.DB("chat").TableCreate("invites").Exec(session)
+	re.DB("chat").TableCreate("links").Exec(session)
+	re.DB("chat").TableCreate("migrations").Exec(session)
+
+	re.DB("chat").Table("users").IndexCreate("keyID").Exec(session)
+	re.DB("chat").Table("users").IndexCreate("nameKey").Exec(session)
+	re.DB("chat").Table("users").IndexCreate("userID").Exec(session)
+	re.DB("chat").Table("users").IndexWait().Exec(session)
+	re.DB("chat").Table("tokens").IndexCreate("userID").Exec(session)
+	re.DB("chat").Table("tokens").IndexWait().Exec(session)
+	re.DB("chat").Table("friendRequests").IndexCreate("from").Exec(session)
+	re.DB("chat").Table("friendRequests").IndexCreate("to").Exec(session)
+	re.DB("chat").Table("friendRequests").IndexWait().Exec(session)
+	re.DB("chat").Table("notifications").IndexCreateFunc("userSeq", func(row re.Term) interface{} {
+		return []interface{}{row.Field("userID"), row.Field("seq")}
+	}).Exec(session)
+	re.DB("chat").Table("notifications").IndexWait().Exec(session)
+	re.DB("chat").Table("invites").IndexCreate("from").Exec(session)
+	re.DB("chat").Table("invites").IndexCreate("to").Exec(session)
+	re.DB("chat").Table("invites").IndexWait().Exec(session)
+	re.DB("chat").Table("links").IndexCreate("roomID").Exec(session)
+	re.DB("chat").Table("links").IndexWait().Exec(session)
+
+	//Anyone could join the rooms created before visibility
+	re.DB("chat").Table("rooms").Filter(re.Row.HasFields("visibility").Not()).Update(map[string]interface{}{
+		"visibility": chat.RoomPublic,
+		"admins":     re.Row.Field("admins").Default([]string{}),
+		"members":    re.Row.Field("members").Default([]string{}),
+	}).Exec(session)
+
+	migrate(session, "hash-secret-keys", func() error {
+		return migrateSecretKeys(session)
+	})
+	migrate(session, "unique-usernames", func() error {
+		return migrateUsernames(session)
+	})
+	migrate(session, "invites-table", func() error {
+		return migrateInvites(session, inviteTTL)
+	})
 }
 
-func revalidateSession(session *re.Session, sessionKey string, user *chat.User) bool {
-	cursor, err := re.DB("chat").Table("users").Filter(re.Row.Field("session").Eq(sessionKey)).Run(session)
+// migrationLease is how long a running migration is left to its instance
+// A migration still running after it was interrupted, it runs again
+const migrationLease = time.Minute * 10
+
+// migrate runs fn only once for the database, even with many instances
+// The primary key of migrations makes it atomic, it is done only when fn succeeds
+func migrate(session *re.Session, id string, fn func() error) {
+	expired := time.Now().UTC().Add(-migrationLease).Format(time.RFC3339)
+	writeInfo, err := re.DB("chat").Table("migrations").Insert(map[string]interface{}{
+		"id":      id,
+		"state":   "running",
+		"started": chat.UTCNow(),
+	}, re.InsertOpts{
+		Conflict: func(id, old, new re.Term) interface{} {
+			return re.Branch(
+				old.Field("state").Default("done").Eq("running").And(old.Field("started").Lt(expired)),
+				new,
+				old,
+			)
+		},
+	}).RunWrite(session)
 	if err != nil {
-		return false
+		log.Println(err)
+		return
 	}
 
-	if err = cursor.One(user); err != nil {
-		return false
+	//Done, or running in another instance
+	if writeInfo.Inserted+writeInfo.Replaced != 1 {
+		return
 	}
 
-	lastTime, _ := time.Parse(user.LastTime, time.RFC3339)
-	if time.Now().Sub(lastTime).Minutes() > 5 {
-		return false
+	if err = fn(); err != nil {
+		log.Printf("Migration '%s' failed: %v\n", id, err)
+		re.DB("chat").Table("migrations").Get(id).Delete().Exec(session)
+		return
 	}
 
-	re.DB("chat").Table("users").Update(map[string]interface{}{
-		"lasttime": time.Now().Format(time.RFC3339),
-	}).Exec(session)
-
-	return true
+	if err = re.DB("chat").Table("migrations").Get(id).Update(map[string]interface{}{
+		"state":    "done",
+		"finished": chat.UTCNow(),
+	}).Exec(session); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Migration '%s' done\n", id)
 }
 
-func main() {
-	//Flags to command line
-	host := flag.String("host", "", "Public Address")
-	port := flag.String("port", "8080", "Public Port Address")
-	dbUser := flag.String("db.username", "", "Admin User RethinkDB")
-	dbPassword := flag.String("db.password", "", "Admin Passwword RethinkDB")
-	dbAddress := flag.String("db.address", "localhost:28015", "Address Rethinkdb")
-	flag.Parse()
+// migrateUsernames reserves the names of the users created before names were unique
+// The oldest user keeps a name, the others are renamed with a random suffix
+func migrateUsernames(session *re.Session) error {
+	cursor, err := re.DB("chat").Table("users").OrderBy("created").Pluck("id", "name", "userID").Run(session)
+	if err != nil {
+		return err
+	}
 
-	//Getting Path
-	path, _ := os.Executable()
-	path = filepath.Join(filepath.Dir(path), "/static")
-	log.Printf("Local Storage: %s", path)
+	users := make([]chat.User, 0)
+	if err = cursor.All(&users); err != nil {
+		return err
+	}
 
-	//Read Static Files
-	log.Println("Reading all static file...")
-	staticFiles := loadAllStaticFiles(path)
-	log.Printf("Read '%d' files\n", len(staticFiles))
+	for _, user := range users {
+		name := user.Name
+		for tries := 0; !ownsName(session, name, user.UserID); tries++ {
+			if tries == 10 {
+				return fmt.Errorf("No free name for user '%s'", user.UserID)
+			}
 
-	//Session
-	sm := chat.NewSessionManager()
+			//Names are at most 10 characters
+			base := user.Name
+			if len(base) > 6 {
+				base = base[:6]
+			}
+			name = base + chat.RandomHex(2)
+		}
 
-	//Hub connecteds
-	hub := chat.NewHub()
+		if name != user.Name {
+			log.Printf("User '%s' renamed from '%s' to '%s'\n", user.UserID, user.Name, name)
+		}
 
-	//Rooms
-	rooms := chat.NewRoomManager()
+		if err = re.DB("chat").Table("users").Get(user.ID).Update(map[string]interface{}{
+			"name":    name,
+			"nameKey": chat.NameKey(name),
+		}).Exec(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	//Create WebRTC Settings
-	configRTC, err := json.Marshal(map[string]interface{}{
-		"iceServers": []map[string]interface{}{
-			map[string]interface{}{
-				"urls":       []string{"stun:numb.viagenie.ca"},
-				"username":   "paulorcamacan@gmail.com",
-				"credential": "swordfish",
-			},
-			map[string]interface{}{
-				"urls":       []string{"turn:numb.viagenie.ca"},
-				"username":   "paulorcamacan@gmail.com",
-				"credential": "swordfish",
-			},
-		},
-	})
+// ownsName reserves name for userID, it is true if it was already reserved by userID
+func ownsName(session *re.Session, name, userID string) bool {
+	if reserveName(session, name, userID) {
+		return true
+	}
 
-	//Settings DB
-	session, err := re.Connect(re.ConnectOpts{
-		Password: *dbPassword,
-		Username: *dbUser,
-		Address:  *dbAddress,
-		Database: "chat",
-	})
+	var owner string
+	cursor, err := re.DB("chat").Table("usernames").Get(chat.NameKey(name)).Field("userID").Run(session)
+	return err == nil && cursor.One(&owner) == nil && owner == userID
+}
 
+// migrateInvites moves the invites kept in the recipients to the invites table
+// They had no expiry, so they expire after ttl from now
+func migrateInvites(session *re.Session, ttl time.Duration) error {
+	cursor, err := re.DB("chat").Table("users").HasFields("invites").Pluck("id", "userID", "invites").Run(session)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	configDB(session)
 
-	//Setting Routers
-	//Index route
-	var route *mux.Router = mux.NewRouter()
+	var legacy []struct {
+		ID      string        `rethinkdb:"id"`
+		UserID  string        `rethinkdb:"userID"`
+		Invites []chat.Invite `rethinkdb:"invites"`
+	}
+	if err = cursor.All(&legacy); err != nil {
+		return err
+	}
 
-	route.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write(staticFiles["/index.html"])
-	}).Methods("GET")
+	for _, user := range legacy {
+		for _, old := range user.Invites {
+			if len(old.RoomID) == 0 {
+				continue
+			}
 
-	route.HandleFunc("/chat.wasm", func(w http.ResponseWriter, r *http.Request) {
-		w.Write(staticFiles["/chat.wasm"])
-	}).Methods("GET")
+			invite := chat.NewInvite(old.From, user.UserID, old.RoomID, ttl)
+			if err = re.DB("chat").Table("invites").Insert(invite, re.InsertOpts{Conflict: "replace"}).Exec(session); err != nil {
+				return err
+			}
+		}
 
-	route.HandleFunc("/wasm_exec.js", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Application", "application/javascript")
-		w.Header().Set("Accept", "application/javascript")
-		w.Write(staticFiles["/wasm_exec.js"])
-	}).Methods("GET")
+		if err = re.DB("chat").Table("users").Get(user.ID).Replace(func(row re.Term) interface{} {
+			return row.Without("invites")
+		}).Exec(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	route.HandleFunc("/testjoin.js", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Application", "application/javascript")
-		w.Header().Set("Accept", "application/javascript")
-		w.Write(staticFiles["/testjoin.js"])
-	}).Methods("GET")
+// migrateSecretKeys hashes the plain keys of the users created before key IDs
+// The legacy key keeps working, its key ID is derived from it
+func migrateSecretKeys(session *re.Session) error {
+	cursor, err := re.DB("chat").Table("users").HasFields("secretKey").Pluck("id", "secretKey").Run(session)
+	if err != nil {
+		return err
+	}
 
-	route.HandleFunc("/configRTC", func(w http.ResponseWriter, r *http.Request) {
-		w.Write(configRTC)
-	}).Methods("GET")
+	legacy := make([]map[string]string, 0)
+	if err = cursor.All(&legacy); err != nil {
+		return err
+	}
 
-	/*** Create Room  ***/
-	route.HandleFunc("/rooms/{roomID}/join", sm.Middleware(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := websocket.Accept(w, r, nil)
+	for _, user := range legacy {
+		hash, err := chat.HashSecret(user["secretKey"])
 		if err != nil {
+			return err
+		}
+
+		if err = re.DB("chat").Table("users").Get(user["id"]).Replace(func(row re.Term) interface{} {
+			return row.Without("secretKey").Merge(map[string]interface{}{
+				"keyID":      chat.LegacyKeyID(user["secretKey"]),
+				"secretHash": hash,
+			})
+		}).Exec(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowLogin writes 429 with Retry-After if any of keys is locked out
+// Otherwise the attempt is reserved on all keys until failLogin or passLogin
+func allowLogin(limiter *chat.LoginLimiter, w http.ResponseWriter, keys ...string) bool {
+	var wait time.Duration
+	allowed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if d, ok := limiter.Allow(key); !ok {
+			if d > wait {
+				wait = d
+			}
+		} else {
+			allowed = append(allowed, key)
+		}
+	}
+
+	if wait == 0 {
+		return true
+	}
+
+	for _, key := range allowed {
+		limiter.Release(key)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	return false
+}
+
+// passLogin ends a successful login, only the failures of the account are forgotten
+func passLogin(limiter *chat.LoginLimiter, ipKey, accountKey string) {
+	limiter.Release(ipKey)
+	limiter.Reset(accountKey)
+}
+
+// failLogin records a failed login for all keys
+func failLogin(limiter *chat.LoginLimiter, keys ...string) {
+	for _, key := range keys {
+		if locked := limiter.Fail(key); locked > 0 {
+			log.Printf("Login lockout: '%s' for %s\n", key, locked)
+		}
+	}
+}
+
+func validName(name string) bool {
+	if len(name) < 4 || len(name) > 10 {
+		return false
+	}
+	matched, _ := regexp.Match("^([$][A-Za-z]|([a-zA-Z]))([_.]?[a-zA-Z0-9])*$", []byte(name))
+	return matched
+}
+
+// validPassword checks the length, bcrypt only uses the first 72 bytes
+func validPassword(password string) bool {
+	return len(password) >= 8 && len(password) <= 72
+}
+
+// reserveName takes a name for userID, it fails if the name is taken
+// The primary key of usernames makes it atomic
+func reserveName(session *re.Session, name, userID string) bool {
+	_, err := re.DB("chat").Table("usernames").Insert(map[string]interface{}{
+		"id":     chat.NameKey(name),
+		"userID": userID,
+	}).RunWrite(session)
+	return err == nil
+}
+
+func releaseName(session *re.Session, name, userID string) {
+	re.DB("chat").Table("usernames").GetAll(chat.NameKey(name)).Filter(re.Row.Field("userID").Eq(userID)).Delete().Exec(session)
+}
+
+// dummyHash is compared when no user is found, so a missing key takes as long as a wrong one
+var dummyHash, _ = chat.HashSecret(chat.RandomHex(32))
+
+func findUserByKey(session *re.Session, key string, user *chat.User) bool {
+	keyID, secret, err := chat.ParseSecretKey(key)
+	if err != nil {
+		//Keys given before key IDs are only the secret
+		if len(key) == 0 {
+			return false
+		}
+		keyID, secret = chat.LegacyKeyID(key), key
+	}
+
+	cursor, err := re.DB("chat").Table("users").GetAllByIndex("keyID", keyID).Run(session)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	if err = cursor.One(user); err != nil {
+		chat.CompareSecret(dummyHash, secret)
+		return false
+	}
+	return chat.CompareSecret(user.SecretHash, secret)
+}
+
+func findUserByID(session *re.Session, userID string, user *chat.User) bool {
+	cursor, err := re.DB("chat").Table("users").GetAllByIndex("userID", userID).Run(session)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return cursor.One(user) == nil
+}
+
+// deleteUser removes a user and every reference to it
+// Its rooms pass to their first admin, the rooms without admins are closed
+// Sessions and hub sockets are closed by the caller
+func deleteUser(session *re.Session, rooms *chat.RoomManager, userID string) (found bool, err error) {
+	writeInfo, err := re.DB("chat").Table("users").GetAllByIndex("userID", userID).Delete().RunWrite(session)
+	if err != nil || writeInfo.Deleted == 0 {
+		return false, err
+	}
+
+	if err = re.DB("chat").Table("rooms").Filter(
+		re.Row.Field("owner").Eq(userID).And(re.Row.Field("admins").Default([]string{}).IsEmpty().Not()),
+	).Update(map[string]interface{}{
+		"owner":  re.Row.Field("admins").Nth(0),
+		"admins": re.Row.Field("admins").DeleteAt(0),
+	}).Exec(session); err != nil {
+		log.Println(err)
+	}
+
+	owned := make([]string, 0)
+	cursor, err := re.DB("chat").Table("rooms").Filter(re.Row.Field("owner").Eq(userID)).Field("id").Run(session)
+	if err == nil {
+		err = cursor.All(&owned)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+
+	for _, roomID := range owned {
+		if err = re.DB("chat").Table("rooms").Get(roomID).Delete().Exec(session); err != nil {
 			log.Println(err)
-			return
+			continue
 		}
-		defer conn.Close(websocket.StatusInternalError, "Connection closed")
+		re.DB("chat").Table("links").GetAllByIndex("roomID", roomID).Delete().Exec(session)
+		rooms.Close(roomID, "Room closed")
+	}
 
-		ctx, close := context.WithCancel(context.Background())
-		defer close()
+	cleanup := []re.Term{
+		re.DB("chat").Table("rooms").Filter(
+			re.Row.Field("admins").Default([]string{}).Contains(userID).Or(re.Row.Field("members").Default([]string{}).Contains(userID)),
+		).Update(map[string]interface{}{
+			"admins":  re.Row.Field("admins").Default([]string{}).SetDifference([]string{userID}),
+			"members": re.Row.Field("members").Default([]string{}).SetDifference([]string{userID}),
+		}),
+		re.DB("chat").Table("links").Filter(re.Row.Field("creator").Eq(userID)).Delete(),
+		re.DB("chat").Table("rooms").Filter(
+			re.Row.Field("banned").Default([]string{}).Contains(userID).Or(re.Row.Field("muted").Default([]string{}).Contains(userID)),
+		).Update(map[string]interface{}{
+			"banned": re.Row.Field("banned").Default([]string{}).SetDifference([]string{userID}),
+			"muted":  re.Row.Field("muted").Default([]string{}).SetDifference([]string{userID}),
+		}),
+		re.DB("chat").Table("rooms").Filter(re.Row.Field("peers").Contains(userID)).Update(map[string]interface{}{
+			"peers": re.Row.Field("peers").SetDifference([]string{userID}),
+		}),
+		re.DB("chat").Table("users").Filter(re.Row.Field("friends").Contains(userID)).Update(map[string]interface{}{
+			"friends": re.Row.Field("friends").SetDifference([]string{userID}),
+		}),
+		re.DB("chat").Table("invites").GetAllByIndex("from", userID).Delete(),
+		re.DB("chat").Table("invites").GetAllByIndex("to", userID).Delete(),
+		re.DB("chat").Table("tokens").GetAllByIndex("userID", userID).Delete(),
+		re.DB("chat").Table("usernames").Filter(re.Row.Field("userID").Eq(userID)).Delete(),
+		re.DB("chat").Table("friendRequests").GetAllByIndex("from", userID).Delete(),
+		re.DB("chat").Table("friendRequests").GetAllByIndex("to", userID).Delete(),
+		re.DB("chat").Table("notifications").Between(
+			[]interface{}{userID, re.MinVal},
+			[]interface{}{userID, re.MaxVal},
+			re.BetweenOpts{Index: "userSeq"},
+		).Delete(),
+		re.DB("chat").Table("users").Filter(re.Row.Field("blocked").Default([]string{}).Contains(userID)).Update(map[string]interface{}{
+			"blocked": re.Row.Field("blocked").SetDifference([]string{userID}),
+		}),
+	}
 
-		userID := r.Header.Get("userID")
-		parms := mux.Vars(r)
+	for _, term := range cleanup {
+		if err = term.Exec(session); err != nil {
+			log.Println(err)
+		}
+	}
+	return true, nil
+}
 
-		info, err := re.DB("chat").Table("rooms").Get(parms["roomID"]).Update(
-			map[string]interface{}{
-				"peers": re.Row.Field("peers").SetInsert(userID),
-			},
-		).RunWrite(session)
-		if err != nil || info.Skipped == 1 {
-			conn.Close(websocket.StatusInternalError, "Room not exists")
-			return
+// setFriends adds or removes both users from the friends of each other
+func setFriends(session *re.Session, userA, userB string, friends bool) error {
+	for _, pair := range [][2]string{{userA, userB}, {userB, userA}} {
+		var friendsList interface{} = re.Row.Field("friends").Default([]string{}).SetInsert(pair[1])
+		if !friends {
+			friendsList = re.Row.Field("friends").Default([]string{}).SetDifference([]string{pair[1]})
 		}
 
-		room, exists := rooms.Load(parms["roomID"])
-		//If the room not exists yet
-		if !exists {
-			room = rooms.Store(parms["roomID"])
+		if err := re.DB("chat").Table("users").GetAllByIndex("userID", pair[0]).Update(map[string]interface{}{
+			"friends": friendsList,
+		}).Exec(session); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		wait := make(chan int, 1)
-		fmt.Println(room.Length())
-		//If already exists connected peers
-		if room.Length() > 0 {
-			//Set userID
-			resp := map[string]interface{}{
-				"event":     "create_offer",
-				"requester": userID,
-				"config":    string(configRTC),
-			}
-
-			//Send Offer all peer
-			room.Range(func(peerID string, peer *websocket.Conn) {
-				if userID == peerID {
-					return
-				}
-				log.Println("send")
-				resp["peerID"] = peerID
-				if err = wsjson.Write(ctx, conn, resp); err != nil {
-					room.Delete(peerID)
-					re.DB("chat").Table("rooms").Get(parms["roomID"]).Update(func(d re.Term) interface{} {
-						return map[string]interface{}{
-							"peers": re.Row.Field("peers").Filter(func(a re.Term) interface{} {
-								return a.Ne(peerID)
-							}),
-						}
-					}).Exec(session)
-					fmt.Println("erro")
-					return
-				}
-			})
+// blockedBy returns which users among have blocked userID
+func blockedBy(session *re.Session, userID string, among ...string) (blockers []string) {
+	blockers = make([]string, 0)
+	if len(among) == 0 {
+		return
+	}
+
+	keys := make([]interface{}, len(among))
+	for i, id := range among {
+		keys[i] = id
+	}
+
+	cursor, err := re.DB("chat").Table("users").GetAllByIndex("userID", keys...).Filter(
+		re.Row.Field("blocked").Default([]string{}).Contains(userID),
+	).Field("userID").Run(session)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err = cursor.All(&blockers); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// blockedAmong returns which users among blocker has blocked
+func blockedAmong(session *re.Session, blocker string, among ...string) (blocked []string) {
+	blocked = make([]string, 0)
+	var user chat.User
+	if len(among) == 0 || !findUserByID(session, blocker, &user) {
+		return
+	}
+
+	set := make(map[string]bool, len(user.Blocked))
+	for _, id := range user.Blocked {
+		set[id] = true
+	}
+	for _, id := range among {
+		if set[id] {
+			blocked = append(blocked, id)
 		}
-		room.Store(userID, conn)
+	}
+	return
+}
 
-		go func() {
-			ctx, cancel := context.WithCancel(context.Background())
+// isBlocked check if blocker has blocked userID
+func isBlocked(session *re.Session, blocker, userID string) bool {
+	return len(blockedBy(session, userID, blocker)) > 0
+}
 
-			defer cancel()
-			for {
-				resp := make(map[string]interface{})
-				if err := wsjson.Read(ctx, conn, &resp); err != nil {
-					room.Delete(userID)
-					//Remove User from Room peers list
-					re.DB("chat").Table("rooms").Get(parms["roomID"]).Update(func(d re.Term) interface{} {
-						return map[string]interface{}{
-							"peers": d.Field("peers").Filter(func(a re.Term) interface{} {
-								return a.Ne(userID)
-							}),
-						}
-					}).RunWrite(session)
-					wait <- 0
-					return
-				}
+// deleteFriendRequest removes a request if field (from or to) is userID
+func deleteFriendRequest(session *re.Session, w http.ResponseWriter, requestID, field, userID string) {
+	writeInfo, err := re.DB("chat").Table("friendRequests").GetAll(requestID).Filter(
+		re.Row.Field(field).Eq(userID),
+	).Delete().RunWrite(session)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-				switch resp["event"] {
+	if writeInfo.Deleted == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resolveToken checks an API token, the user must not be suspended
+func resolveToken(session *re.Session, value string) (auth chat.Session, valid bool) {
+	id, secret, ok := chat.ParseToken(value)
+	if !ok {
+		return
+	}
+
+	cursor, err := re.DB("chat").Table("tokens").Get(id).Run(session)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var token chat.Token
+	if err = cursor.One(&token); err != nil {
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(chat.EncodeToSha(secret))) != 1 {
+		return
+	}
+
+	var user chat.User
+	if !findUserByID(session, token.UserID, &user) || user.Suspended {
+		return
+	}
+
+	re.DB("chat").Table("tokens").Get(id).Update(map[string]interface{}{
+		"lastUsed": time.Now().Format(time.RFC3339),
+	}).Exec(session, re.ExecOpts{NoReply: true})
+
+	return chat.Session{
+		Expire:  time.Now().Add(time.Minute),
+		UserID:  token.UserID,
+		TokenID: token.ID,
+		Scopes:  token.Scopes,
+	}, true
+}
+
+func findUserByPassword(session *re.Session, name, password string, user *chat.User) bool {
+	cursor, err := re.DB("chat").Table("users").GetAllByIndex("nameKey", chat.NameKey(name)).Filter(re.Row.HasFields("passwordHash")).Run(session)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	if err = cursor.One(user); err != nil {
+		chat.CompareSecret(dummyHash, password)
+		return false
+	}
+	return chat.CompareSecret(user.PassHash, password)
+}
+
+// notifyPresence sends the presence of a user to its friends
+// Going offline is the last time the user was seen
+func notifyPresence(session *re.Session, hub *chat.Hub, userID, presence string) {
+	var user chat.User
+	if !findUserByID(session, userID, &user) {
+		return
+	}
+
+	info := map[string]interface{}{
+		"userID":   userID,
+		"presence": presence,
+	}
+
+	if presence == chat.PresenceOffline {
+		user.LastTime = time.Now().Format(time.RFC3339)
+		info["lastTime"] = user.LastTime
+		if err := re.DB("chat").Table("users").Get(user.ID).Update(map[string]interface{}{
+			"lasttime": user.LastTime,
+		}).Exec(session); err != nil {
+			log.Println(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, friend := range user.Friends {
+		hub.WriteTo(ctx, "presence", info, friend)
+	}
+}
+
+// writeError answers with status and the message in JSON
+func writeError(w http.ResponseWriter, status int, message string) {
+	setHeaderJSON(w)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": message,
+	})
+}
+
+func findRoom(session *re.Session, roomID string, room *chat.RoomInfo) bool {
+	if len(roomID) == 0 {
+		return false
+	}
+
+	cursor, err := re.DB("chat").Table("rooms").Get(roomID).Run(session)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return !cursor.IsNil() && cursor.One(room) == nil
+}
+
+// ownedRoom finds a room that userID owns, otherwise it answers 404 or 403
+func ownedRoom(session *re.Session, w http.ResponseWriter, roomID, userID string, room *chat.RoomInfo) bool {
+	if !findRoom(session, roomID, room) {
+		writeError(w, http.StatusNotFound, "Room not found")
+		return false
+	}
+
+	if room.Owner != userID {
+		writeError(w, http.StatusForbidden, "Only the owner can manage the room")
+		return false
+	}
+	return true
+}
+
+func findLink(session *re.Session, token string, link *chat.RoomLink) bool {
+	cursor, err := re.DB("chat").Table("links").Get(chat.RoomLinkID(token)).Run(session)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return !cursor.IsNil() && cursor.One(link) == nil
+}
+
+// roomAction finds the room and the target user of a moderation
+// The target is in the path or in the body as {"user"}
+func roomAction(session *re.Session, w http.ResponseWriter, r *http.Request, room *chat.RoomInfo) (actor, target string, ok bool) {
+	actor = chat.UserIDFrom(r.Context())
+	parms := mux.Vars(r)
+
+	target = parms["userID"]
+	if len(target) == 0 {
+		info := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil || len(info["user"]) == 0 {
+			writeError(w, http.StatusBadRequest, "Missing user")
+			return
+		}
+		target = info["user"]
+	}
+
+	if !findRoom(session, parms["roomID"], room) {
+		writeError(w, http.StatusNotFound, "Room not found")
+		return
+	}
+	return actor, target, true
+}
+
+// moderateRoom applies update to the room if actor can moderate target
+// A found error is 404, without found any user can be moderated
+// With a reason target is then kicked, it answers 204 and warns the room with event
+func moderateRoom(session *re.Session, rooms *chat.RoomManager, w http.ResponseWriter, r *http.Request, event, reason string, found func(room *chat.RoomInfo, target string) error, update func(target string) interface{}) {
+	var room chat.RoomInfo
+	actor, target, ok := roomAction(session, w, r, &room)
+	if !ok {
+		return
+	}
+
+	if !room.CanModerate(actor, target) {
+		writeError(w, http.StatusForbidden, "Not allowed to moderate this user")
+		return
+	}
+
+	if found != nil {
+		if err := found(&room, target); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+	}
+
+	if err := re.DB("chat").Table("rooms").Get(room.ID).Update(update(target)).Exec(session); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(reason) > 0 {
+		rooms.Kick(room.ID, target, reason)
+	}
+	roomEvent(rooms, room.ID, event, target)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownRoom applies update to the room only if actor is still its owner
+// A valid error about target is 400, it answers 204 and warns the room with event
+func ownRoom(session *re.Session, rooms *chat.RoomManager, w http.ResponseWriter, r *http.Request, event string, valid func(room *chat.RoomInfo, target string) error, update func(actor, target string) interface{}) {
+	var room chat.RoomInfo
+	actor, target, ok := roomAction(session, w, r, &room)
+	if !ok {
+		return
+	}
+
+	if room.Owner != actor {
+		writeError(w, http.StatusForbidden, "Only the owner can manage the room")
+		return
+	}
+
+	if actor == target {
+		writeError(w, http.StatusBadRequest, "The owner can not manage itself")
+		return
+	}
+
+	if err := valid(&room, target); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeInfo, err := re.DB("chat").Table("rooms").GetAll(room.ID).Filter(
+		re.Row.Field("owner").Eq(actor),
+	).Update(update(actor, target)).RunWrite(session)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if writeInfo.Replaced+writeInfo.Unchanged == 0 {
+		writeError(w, http.StatusForbidden, "Only the owner can manage the room")
+		return
+	}
+
+	roomEvent(rooms, room.ID, event, target)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// roomEvent warns every peer of a room about userID
+func roomEvent(rooms *chat.RoomManager, roomID, event, userID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	rooms.Write(ctx, roomID, map[string]interface{}{
+		"event":  event,
+		"userID": userID,
+	})
+}
+
+// takeInvite removes a valid invite to userID and returns it
+// Only one request can take an invite, the others get 404
+func takeInvite(session *re.Session, w http.ResponseWriter, inviteID, userID string) (invite chat.Invite, found bool) {
+	writeInfo, err := re.DB("chat").Table("invites").GetAll(inviteID).Filter(
+		re.Row.Field("to").Eq(userID).And(re.Row.Field("expires").Gt(chat.UTCNow())),
+	).Delete(re.DeleteOpts{ReturnChanges: true}).RunWrite(session)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if writeInfo.Deleted == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	old := writeInfo.Changes[0].OldValue.(map[string]interface{})
+	invite.ID, _ = old["id"].(string)
+	invite.From, _ = old["from"].(string)
+	invite.To, _ = old["to"].(string)
+	invite.RoomID, _ = old["roomID"].(string)
+	return invite, true
+}
+
+// notify stores an event until the user acknowledges it, and sends it if the user is connected
+func notify(session *re.Session, hub *chat.Hub, userID, event string, message interface{}) {
+	seq, err := nextSeq(session, userID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	n := chat.NewNotification(userID, seq, event, message)
+	if _, err := re.DB("chat").Table("notifications").Insert(n).RunWrite(session); err != nil {
+		log.Println(err)
+	}
+	hub.Deliver(n)
+}
+
+// nextSeq counts the notifications of a user, so they are ordered from any instance
+func nextSeq(session *re.Session, userID string) (int64, error) {
+	writeInfo, err := re.DB("chat").Table("users").GetAllByIndex("userID", userID).Update(map[string]interface{}{
+		"notifySeq": re.Row.Field("notifySeq").Default(0).Add(1),
+	}, re.UpdateOpts{ReturnChanges: true}).RunWrite(session)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(writeInfo.Changes) == 0 {
+		return 0, errors.New("User not found")
+	}
+
+	user, _ := writeInfo.Changes[0].NewValue.(map[string]interface{})
+	seq, _ := user["notifySeq"].(float64)
+	return int64(seq), nil
+}
+
+// flushNotifications sends in order the events not acknowledged by a user
+// On an error the hub closes the connection, the client joins again
+// The hub holds the live events until it ends, an event stored meanwhile can be
+// received twice, the client knows them by ID
+func flushNotifications(ctx context.Context, session *re.Session, userID string, peer chat.Peer) error {
+	cursor, err := re.DB("chat").Table("notifications").Between(
+		[]interface{}{userID, re.MinVal},
+		[]interface{}{userID, re.MaxVal},
+		re.BetweenOpts{Index: "userSeq"},
+	).OrderBy(re.OrderByOpts{Index: "userSeq"}).Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	var n chat.Notification
+	for cursor.Next(&n) {
+		if err = peer.Write(ctx, n); err != nil {
+			return err
+		}
+		n = chat.Notification{}
+	}
+	return cursor.Err()
+}
+
+// leaveRoom removes a peer from a room and warns the others
+// A dead connection leaves the same way as a normal disconnect
+func leaveRoom(session *re.Session, rooms *chat.RoomManager, room *chat.Room, roomID, userID string, conn *websocket.Conn) {
+	if !room.Remove(userID, conn) {
+		return
+	}
+
+	//Remove User from Room peers list
+	if err := re.DB("chat").Table("rooms").Get(roomID).Update(func(d re.Term) interface{} {
+		return map[string]interface{}{
+			"peers": d.Field("peers").Filter(func(a re.Term) interface{} {
+				return a.Ne(userID)
+			}),
+		}
+	}).Exec(session); err != nil {
+		log.Println(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	rooms.Write(ctx, roomID, map[string]interface{}{
+		"event":  "peer_left",
+		"peerID": userID,
+	})
+}
+
+func revalidateSession(session *re.Session, sessionKey string, user *chat.User) bool {
+	cursor, err := re.DB("chat").Table("users").Filter(re.Row.Field("session").Eq(sessionKey)).Run(session)
+	if err != nil {
+		return false
+	}
+
+	if err = cursor.One(user); err != nil {
+		return false
+	}
+
+	lastTime, _ := time.Parse(user.LastTime, time.RFC3339)
+	if time.Now().Sub(lastTime).Minutes() > 5 {
+		return false
+	}
+
+	re.DB("chat").Table("users").Update(map[string]interface{}{
+		"lasttime": time.Now().Format(time.RFC3339),
+	}).Exec(session)
+
+	return true
+}
+
+func main() {
+	//Flags to command line
+	host := flag.String("host", "", "Public Address")
+	port := flag.String("port", "8080", "Public Port Address")
+	dbUser := flag.String("db.username", "", "Admin User RethinkDB")
+	dbPassword := flag.String("db.password", "", "Admin Passwword RethinkDB")
+	dbAddress := flag.String("db.address", "localhost:28015", "Address Rethinkdb")
+	loginAttempts := flag.Int("login.attempts", 5, "Failed logins before lockout")
+	loginLockout := flag.Duration("login.lockout", time.Minute, "First lockout, it doubles on each new failure")
+	loginMaxLockout := flag.Duration("login.maxlockout", time.Hour, "Longest lockout")
+	admins := flag.String("admins", "", "Comma-separated userIDs granted the admin role")
+	avatarsPath := flag.String("avatars", "", "Avatars folder, next to the executable by default")
+	wsPing := flag.Duration("ws.ping", time.Second*30, "Interval between pings to each WebSocket")
+	wsTimeout := flag.Duration("ws.timeout", time.Second*10, "Time to answer a ping before the WebSocket is closed")
+	inviteTTL := flag.Duration("invite.ttl", time.Hour*24*7, "Time to accept an invite")
+	busKind := flag.String("bus", "local", "Bus between instances: local (single instance) or rethinkdb")
+	flag.Parse()
+
+	//Getting Path
+	path, _ := os.Executable()
+	if len(*avatarsPath) == 0 {
+		*avatarsPath = filepath.Join(filepath.Dir(path), "/avatars")
+	}
+	path = filepath.Join(filepath.Dir(path), "/static")
+	log.Printf("Local Storage: %s", path)
+
+	//Uploaded avatars
+	avatars, err := chat.NewAvatarStore(*avatarsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Read Static Files
+	log.Println("Reading all static file...")
+	staticFiles := loadAllStaticFiles(path)
+	log.Printf("Read '%d' files\n", len(staticFiles))
+
+	//Session
+	sm := chat.NewSessionManager()
+
+	//Failed logins by remote IP and by account
+	limiter := chat.NewLoginLimiter(*loginAttempts, *loginLockout, *loginMaxLockout)
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			limiter.Prune(*loginMaxLockout)
+		}
+	}()
+
+	//Hub connecteds
+	hub := chat.NewHub()
+
+	//Rooms
+	rooms := chat.NewRoomManager()
+
+	//Create WebRTC Settings
+	configRTC, err := json.Marshal(map[string]interface{}{
+		"iceServers": []map[string]interface{}{
+			map[string]interface{}{
+				"urls":       []string{"stun:numb.viagenie.ca"},
+				"username":   "paulorcamacan@gmail.com",
+				"credential": "swordfish",
+			},
+			map[string]interface{}{
+				"urls":       []string{"turn:numb.viagenie.ca"},
+				"username":   "paulorcamacan@gmail.com",
+				"credential": "swordfish",
+			},
+		},
+	})
+
+	//Settings DB
+	session, err := re.Connect(re.ConnectOpts{
+		Password: *dbPassword,
+		Username: *dbUser,
+		Address:  *dbAddress,
+		Database: "chat",
+	})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	configDB(session, *inviteTTL)
+	sm.SetTokenResolver(func(token string) (chat.Session, bool) {
+		return resolveToken(session, token)
+	})
+	hub.OnPresence(func(userID, presence string) {
+		notifyPresence(session, hub, userID, presence)
+	})
+
+	//Expired invites
+	go func() {
+		for {
+			if err := re.DB("chat").Table("invites").Filter(
+				re.Row.Field("expires").Le(chat.UTCNow()),
+			).Delete().Exec(session); err != nil {
+				log.Println(err)
+			}
+			time.Sleep(time.Minute * 10)
+		}
+	}()
+
+	//Bus between instances
+	switch *busKind {
+	case "local":
+		bus := chat.NewLocalBus()
+		hub.SetBus(bus)
+		rooms.SetBus(bus)
+	case "rethinkdb":
+		bus := chat.NewRethinkBus(session, re.DB("chat").Table("bus"))
+		hub.SetBus(bus)
+		rooms.SetBus(bus)
+		go func() {
+			for {
+				time.Sleep(time.Minute)
+				if err := bus.Prune(time.Minute); err != nil {
+					log.Println(err)
+				}
+			}
+		}()
+	default:
+		log.Fatalf("Bus '%s' not valid", *busKind)
+	}
+
+	//Bootstrap the admins
+	for _, userID := range strings.Split(*admins, ",") {
+		if userID = strings.TrimSpace(userID); len(userID) > 0 {
+			re.DB("chat").Table("users").Filter(re.Row.Field("userID").Eq(userID)).Update(map[string]interface{}{
+				"role": chat.RoleAdmin,
+			}).Exec(session)
+		}
+	}
+
+	//Setting Routers
+	//Index route
+	var route *mux.Router = mux.NewRouter()
+
+	route.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(staticFiles["/index.html"])
+	}).Methods("GET")
+
+	route.HandleFunc("/chat.wasm", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(staticFiles["/chat.wasm"])
+	}).Methods("GET")
+
+	route.HandleFunc("/wasm_exec.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Application", "application/javascript")
+		w.Header().Set("Accept", "application/javascript")
+		w.Write(staticFiles["/wasm_exec.js"])
+	}).Methods("GET")
+
+	route.HandleFunc("/testjoin.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Application", "application/javascript")
+		w.Header().Set("Accept", "application/javascript")
+		w.Write(staticFiles["/testjoin.js"])
+	}).Methods("GET")
+
+	route.HandleFunc("/configRTC", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(configRTC)
+	}).Methods("GET")
+
+	/*** Create Room  ***/
+	route.HandleFunc("/rooms/{roomID}/join", sm.SocketMiddleware(chat.RequireScope(chat.ScopeMessagesWrite, func(w http.ResponseWriter, r *http.Request) {
+		userID := chat.UserIDFrom(r.Context())
+		parms := mux.Vars(r)
+
+		var roomInfo chat.RoomInfo
+		if !findRoom(session, parms["roomID"], &roomInfo) {
+			writeError(w, http.StatusNotFound, "Room not found")
+			return
+		}
+
+		if roomInfo.IsBanned(userID) {
+			writeError(w, http.StatusForbidden, "Banned from the room")
+			return
+		}
+
+		if !roomInfo.CanJoin(userID) {
+			writeError(w, http.StatusForbidden, "Room is private")
+			return
+		}
+
+		//A locked room needs a ticket from unlock, except for the members
+		if len(roomInfo.Password) > 0 && !roomInfo.IsMember(userID) {
+			auth, valid := sm.RedeemTicket(r.URL.Query().Get("roomTicket"), chat.RoomTicket(roomInfo.ID))
+			if !valid || auth.UserID != userID {
+				writeError(w, http.StatusForbidden, "Room is locked")
+				return
+			}
+		}
+
+		conn, err := websocket.Accept(w, r, chat.AcceptOptions(r))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer conn.Close(websocket.StatusInternalError, "Connection closed")
+
+		ctx, close := context.WithCancel(context.Background())
+		defer close()
+
+		info, err := re.DB("chat").Table("rooms").Get(parms["roomID"]).Update(
+			map[string]interface{}{
+				"peers": re.Row.Field("peers").SetInsert(userID),
+			},
+		).RunWrite(session)
+		if err != nil || info.Skipped == 1 {
+			conn.Close(websocket.StatusInternalError, "Room not exists")
+			return
+		}
+
+		room, exists := rooms.Load(parms["roomID"])
+		//If the room not exists yet
+		if !exists {
+			room = rooms.Store(parms["roomID"])
+		}
+
+		//Peers of the room connected to any instance
+		peers := make([]string, 0)
+		cursor, err := re.DB("chat").Table("rooms").Get(parms["roomID"]).Field("peers").Run(session)
+		if err == nil {
+			err = cursor.One(&peers)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+
+		wait := make(chan int, 1)
+		//Set userID
+		resp := map[string]interface{}{
+			"event":     "create_offer",
+			"requester": userID,
+			"config":    string(configRTC),
+		}
+
+		//Send Offer all peer, a broken conn is cleaned when the read fails
+		for _, peerID := range peers {
+			if userID == peerID {
+				continue
+			}
+			resp["peerID"] = peerID
+			if err = wsjson.Write(ctx, conn, resp); err != nil {
+				log.Println(err)
+				break
+			}
+		}
+		room.Store(userID, conn)
+
+		//Who joins disables the tracks of the muted users, its own included
+		//They are read once connected, so a later mute reaches it as an event
+		muted := make([]string, 0)
+		cursor, err = re.DB("chat").Table("rooms").Get(parms["roomID"]).Field("muted").Default([]string{}).Run(session)
+		if err == nil {
+			err = cursor.One(&muted)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+
+		for _, mutedID := range muted {
+			wsjson.Write(ctx, conn, map[string]interface{}{
+				"event":  "muted",
+				"userID": mutedID,
+			})
+		}
+
+		//Warn the peers that blocked who is joining
+		for _, blocker := range blockedBy(session, userID, peers...) {
+			rooms.WriteTo(ctx, parms["roomID"], blocker, map[string]interface{}{
+				"event":  "blocked_user_joined",
+				"userID": userID,
+			})
+		}
+
+		//Warn who is joining about the peers it blocked
+		for _, blocked := range blockedAmong(session, userID, peers...) {
+			wsjson.Write(ctx, conn, map[string]interface{}{
+				"event":  "blocked_user_in_room",
+				"userID": blocked,
+			})
+		}
+
+		//A connection that misses a ping is closed by ending the read
+		go func() {
+			if err := chat.Heartbeat(ctx, conn, *wsPing, *wsTimeout); err != nil {
+				log.Printf("Room heartbeat failed: %s %v\n", userID, err)
+				close()
+			}
+		}()
+
+		go func() {
+			ctx, cancel := context.WithCancel(ctx)
+
+			defer cancel()
+			for {
+				resp := make(map[string]interface{})
+				if err := wsjson.Read(ctx, conn, &resp); err != nil {
+					leaveRoom(session, rooms, room, parms["roomID"], userID, conn)
+					wait <- 0
+					return
+				}
+
+				//The other peer can be in another instance
+				switch resp["event"] {
 				case "answer":
-					peer, exists := room.Load(resp["requester"].(string))
-					if !exists {
-						continue
-					}
-					if err := wsjson.Write(ctx, peer, resp); err != nil {
+					requester, _ := resp["requester"].(string)
+					if err := rooms.WriteTo(ctx, parms["roomID"], requester, resp); err != nil {
 						fmt.Println(err)
 					}
 					fmt.Println("Send answer")
 				case "offer":
-					peer, exists := room.Load(resp["peerID"].(string))
-					if !exists {
-						continue
-					}
-					if err := wsjson.Write(ctx, peer, resp); err != nil {
+					peerID, _ := resp["peerID"].(string)
+					if err := rooms.WriteTo(ctx, parms["roomID"], peerID, resp); err != nil {
 						fmt.Println(err)
 					}
 					fmt.Println("Send offer")
 				}
 			}
-		}()
-		room.Store(userID, conn)
-		<-wait
-	}))
+		}()
+		room.Store(userID, conn)
+		<-wait
+	})))
+
+	//Create room
+	route.HandleFunc("/rooms", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+		var userID string = chat.UserIDFrom(r.Context())
+
+		data := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		//Rooms are public unless asked, only members can join a private one
+		visibility, ok := data["visibility"].(string)
+		if !ok {
+			visibility = chat.RoomPublic
+		}
+
+		if !chat.ValidVisibility(visibility) {
+			writeError(w, http.StatusBadRequest, "Visibility must be public or private")
+			return
+		}
+
+		room := map[string]interface{}{
+			"name":       data["roomName"],
+			"peers":      []string{},
+			"owner":      userID,
+			"admins":     []string{},
+			"members":    []string{},
+			"visibility": visibility,
+		}
+
+		//Password is optional, only its hash is stored
+		if password, ok := data["password"].(string); ok && len(password) > 0 {
+			if len(password) > 72 {
+				writeError(w, http.StatusBadRequest, "Password too long")
+				return
+			}
+
+			hash, err := chat.HashSecret(password)
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			room["password"] = hash
+		}
+
+		result, err := re.DB("chat").Table("rooms").Insert(room).RunWrite(session)
+
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"roomID": result.GeneratedKeys[0],
+		})
+	}))).Methods("POST")
+
+	/* Room Get Info */
+	route.HandleFunc("/rooms/{roomID}", sm.Middleware(chat.RequireScope(chat.ScopeRoomsRead, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+		var userID string = chat.UserIDFrom(r.Context())
+
+		parms := mux.Vars(r)
+
+		cursor, err := re.DB("chat").Table("rooms").Get(parms["roomID"]).Run(session)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if cursor.IsNil() {
+			log.Println(err)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		var roomInfo chat.RoomInfo
+		if err = cursor.One(&roomInfo); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		roomInfo.Locked = len(roomInfo.Password) > 0
+
+		if !roomInfo.CanJoin(userID) {
+			writeError(w, http.StatusForbidden, "Room is private")
+			return
+		}
+
+		//Only the members see who is in the room
+		if !roomInfo.IsMember(userID) {
+			roomInfo = roomInfo.Public()
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(roomInfo)
+	}))).Methods("GET")
+
+	//Unlock a room with its password, the ticket is used to join
+	route.HandleFunc("/rooms/{roomID}/unlock", sm.Middleware(chat.RequireScope(chat.ScopeMessagesWrite, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+		auth, _ := chat.SessionFrom(r.Context())
+
+		info := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+
+		var room chat.RoomInfo
+		if !findRoom(session, mux.Vars(r)["roomID"], &room) {
+			writeError(w, http.StatusNotFound, "Room not found")
+			return
+		}
+
+		if !room.CanJoin(auth.UserID) {
+			writeError(w, http.StatusForbidden, "Room is private")
+			return
+		}
+
+		//Same lockout as the logins against guessing
+		var key string = "room:" + room.ID + ":" + auth.UserID
+		if !allowLogin(limiter, w, key) {
+			return
+		}
+
+		if len(room.Password) > 0 && !chat.CompareSecret(room.Password, info["password"]) {
+			failLogin(limiter, key)
+			writeError(w, http.StatusForbidden, "Wrong password")
+			return
+		}
+		limiter.Reset(key)
+
+		ticket := sm.Ticket(time.Second*30, auth, chat.RoomTicket(room.ID))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"roomTicket": ticket,
+			"expires":    30,
+		})
+	}))).Methods("POST")
+
+	/*** ROOM MODERATION ***/
+	//Kick closes the socket, the user can join again
+	route.HandleFunc("/rooms/{roomID}/kick", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		moderateRoom(session, rooms, w, r, "kicked", "Kicked", func(room *chat.RoomInfo, target string) error {
+			if !room.IsConnected(target) {
+				return errors.New("User is not in the room")
+			}
+			return nil
+		}, func(target string) interface{} {
+			return map[string]interface{}{
+				"peers": re.Row.Field("peers").SetDifference([]string{target}),
+			}
+		})
+	}))).Methods("POST")
+
+	//Ban also ends the membership
+	route.HandleFunc("/rooms/{roomID}/bans", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		moderateRoom(session, rooms, w, r, "banned", "Banned", nil, func(target string) interface{} {
+			return map[string]interface{}{
+				"banned":  re.Row.Field("banned").Default([]string{}).SetInsert(target),
+				"admins":  re.Row.Field("admins").Default([]string{}).SetDifference([]string{target}),
+				"members": re.Row.Field("members").Default([]string{}).SetDifference([]string{target}),
+				"peers":   re.Row.Field("peers").SetDifference([]string{target}),
+			}
+		})
+	}))).Methods("POST")
+
+	route.HandleFunc("/rooms/{roomID}/bans/{userID}", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		moderateRoom(session, rooms, w, r, "unbanned", "", func(room *chat.RoomInfo, target string) error {
+			if !room.IsBanned(target) {
+				return errors.New("User is not banned")
+			}
+			return nil
+		}, func(target string) interface{} {
+			return map[string]interface{}{
+				"banned": re.Row.Field("banned").Default([]string{}).SetDifference([]string{target}),
+			}
+		})
+	}))).Methods("DELETE")
+
+	//The clients disable the tracks of a muted user
+	route.HandleFunc("/rooms/{roomID}/mutes", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		moderateRoom(session, rooms, w, r, "muted", "", nil, func(target string) interface{} {
+			return map[string]interface{}{
+				"muted": re.Row.Field("muted").Default([]string{}).SetInsert(target),
+			}
+		})
+	}))).Methods("POST")
+
+	route.HandleFunc("/rooms/{roomID}/mutes/{userID}", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		moderateRoom(session, rooms, w, r, "unmuted", "", func(room *chat.RoomInfo, target string) error {
+			if !room.IsMuted(target) {
+				return errors.New("User is not muted")
+			}
+			return nil
+		}, func(target string) interface{} {
+			return map[string]interface{}{
+				"muted": re.Row.Field("muted").Default([]string{}).SetDifference([]string{target}),
+			}
+		})
+	}))).Methods("DELETE")
+
+	//Only the owner promotes members to admins
+	route.HandleFunc("/rooms/{roomID}/admins", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		ownRoom(session, rooms, w, r, "admin_added", func(room *chat.RoomInfo, target string) error {
+			if !room.IsMember(target) || room.IsAdmin(target) {
+				return errors.New("User is not a member")
+			}
+			return nil
+		}, func(actor, target string) interface{} {
+			return map[string]interface{}{
+				"admins":  re.Row.Field("admins").Default([]string{}).SetInsert(target),
+				"members": re.Row.Field("members").Default([]string{}).SetDifference([]string{target}),
+			}
+		})
+	}))).Methods("POST")
+
+	route.HandleFunc("/rooms/{roomID}/admins/{userID}", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		ownRoom(session, rooms, w, r, "admin_removed", func(room *chat.RoomInfo, target string) error {
+			if !room.IsAdmin(target) {
+				return errors.New("User is not an admin")
+			}
+			return nil
+		}, func(actor, target string) interface{} {
+			return map[string]interface{}{
+				"admins":  re.Row.Field("admins").Default([]string{}).SetDifference([]string{target}),
+				"members": re.Row.Field("members").Default([]string{}).SetInsert(target),
+			}
+		})
+	}))).Methods("DELETE")
+
+	//The old owner stays as admin
+	route.HandleFunc("/rooms/{roomID}/owner", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		ownRoom(session, rooms, w, r, "owner_changed", func(room *chat.RoomInfo, target string) error {
+			if !room.IsMember(target) {
+				return errors.New("User is not a member")
+			}
+			return nil
+		}, func(actor, target string) interface{} {
+			return map[string]interface{}{
+				"owner":   target,
+				"admins":  re.Row.Field("admins").Default([]string{}).SetDifference([]string{target}).SetInsert(actor),
+				"members": re.Row.Field("members").Default([]string{}).SetDifference([]string{target}),
+			}
+		})
+	}))).Methods("POST")
+
+	/*** ROOM LINKS ***/
+	route.HandleFunc("/rooms/{roomID}/links", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+		var userID string = chat.UserIDFrom(r.Context())
+
+		//Both options are optional, zero means no limit
+		var options struct {
+			MaxUses   int `json:"maxUses"`
+			ExpiresIn int `json:"expiresIn"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&options); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+
+		if options.MaxUses < 0 || options.ExpiresIn < 0 {
+			writeError(w, http.StatusBadRequest, "Limits must be positive")
+			return
+		}
+
+		var room chat.RoomInfo
+		if !ownedRoom(session, w, mux.Vars(r)["roomID"], userID, &room) {
+			return
+		}
+
+		link := chat.NewRoomLink(room.ID, userID, options.MaxUses, time.Duration(options.ExpiresIn)*time.Second)
+		if _, err := re.DB("chat").Table("links").Insert(link).RunWrite(session); err != nil {
+			log.Println(err)
+			writeError(w, http.StatusBadRequest, "Error to store link")
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(link)
+	}))).Methods("POST")
+
+	route.HandleFunc("/rooms/{roomID}/links", sm.Middleware(chat.RequireScope(chat.ScopeRoomsRead, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		var userID string = chat.UserIDFrom(r.Context())
+
+		var room chat.RoomInfo
+		if !ownedRoom(session, w, mux.Vars(r)["roomID"], userID, &room) {
+			return
+		}
+
+		cursor, err := re.DB("chat").Table("links").GetAllByIndex("roomID", room.ID).OrderBy("created").Run(session)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		links := make([]chat.RoomLink, 0)
+		if err = cursor.All(&links); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(links)
+	}))).Methods("GET")
+
+	route.HandleFunc("/rooms/{roomID}/links/{linkID}", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		var userID string = chat.UserIDFrom(r.Context())
+		parms := mux.Vars(r)
+
+		var room chat.RoomInfo
+		if !ownedRoom(session, w, parms["roomID"], userID, &room) {
+			return
+		}
+
+		writeInfo, err := re.DB("chat").Table("links").GetAllByIndex("roomID", room.ID).Filter(
+			re.Row.Field("linkID").Eq(parms["linkID"]),
+		).Delete().RunWrite(session)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if writeInfo.Deleted == 0 {
+			writeError(w, http.StatusNotFound, "Link not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("DELETE")
+
+	//Anyone with the link can see the room it leads to
+	route.HandleFunc("/join/{token}", func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+
+		var link chat.RoomLink
+		var room chat.RoomInfo
+		if !findLink(session, mux.Vars(r)["token"], &link) || !findRoom(session, link.RoomID, &room) {
+			writeError(w, http.StatusNotFound, "Link not found")
+			return
+		}
+
+		if !link.Valid() {
+			writeError(w, http.StatusGone, "Link expired")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"roomID": room.ID,
+			"name":   room.Name,
+		})
+	}).Methods("GET")
+
+	//Redeeming makes the user a member, a member does not use the link
+	route.HandleFunc("/join/{token}", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		var userID string = chat.UserIDFrom(r.Context())
+
+		var link chat.RoomLink
+		var room chat.RoomInfo
+		if !findLink(session, mux.Vars(r)["token"], &link) || !findRoom(session, link.RoomID, &room) {
+			writeError(w, http.StatusNotFound, "Link not found")
+			return
+		}
+
+		if room.IsBanned(userID) {
+			writeError(w, http.StatusForbidden, "Banned from the room")
+			return
+		}
+
+		if !room.IsMember(userID) {
+			//Check and count the use at once, concurrent uses can not exceed the limit
+			writeInfo, err := re.DB("chat").Table("links").Get(link.ID).Update(func(l re.Term) interface{} {
+				return re.Branch(
+					l.Field("expires").Eq("").Or(l.Field("expires").Gt(chat.UTCNow())).And(
+						l.Field("maxUses").Eq(0).Or(l.Field("uses").Lt(l.Field("maxUses"))),
+					),
+					map[string]interface{}{"uses": l.Field("uses").Add(1)},
+					re.Error("Link expired"),
+				)
+			}).RunWrite(session)
+			if writeInfo.Errors > 0 {
+				writeError(w, http.StatusGone, "Link expired")
+				return
+			}
+
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if writeInfo.Skipped == 1 {
+				writeError(w, http.StatusNotFound, "Link not found")
+				return
+			}
+
+			if err = re.DB("chat").Table("rooms").Get(room.ID).Update(map[string]interface{}{
+				"members": re.Row.Field("members").Default([]string{}).SetInsert(userID),
+			}).Exec(session); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"roomID": room.ID,
+			"name":   room.Name,
+			"join":   "/rooms/" + room.ID + "/join",
+		})
+	}))).Methods("POST")
+
+	route.HandleFunc("/invite", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		var userID string = chat.UserIDFrom(r.Context())
+
+		resp := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+			log.Println(err)
+			writeError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+
+		to, _ := resp["to"].(string)
+		roomID, _ := resp["roomID"].(string)
+		if userID == to {
+			writeError(w, http.StatusBadRequest, "Can not invite yourself")
+			return
+		}
+
+		var room chat.RoomInfo
+		if !findRoom(session, roomID, &room) {
+			writeError(w, http.StatusNotFound, "Room not found")
+			return
+		}
+
+		if !room.InRoom(userID) {
+			writeError(w, http.StatusForbidden, "Only who is in the room can invite")
+			return
+		}
+
+		var recipient chat.User
+		if !findUserByID(session, to, &recipient) {
+			writeError(w, http.StatusNotFound, "User not found")
+			return
+		}
+
+		if isBlocked(session, to, userID) {
+			writeError(w, http.StatusForbidden, "User not available")
+			return
+		}
+
+		if room.IsBanned(to) {
+			writeError(w, http.StatusForbidden, "User is banned from the room")
+			return
+		}
+
+		if room.IsMember(to) {
+			writeError(w, http.StatusConflict, "User is already a member")
+			return
+		}
+
+		//An expired invite not cleaned yet is replaced
+		invite := chat.NewInvite(userID, to, roomID, *inviteTTL)
+		writeInfo, err := re.DB("chat").Table("invites").Insert(invite, re.InsertOpts{
+			Conflict: func(id, old, new re.Term) interface{} {
+				return re.Branch(old.Field("expires").Gt(chat.UTCNow()), old, new)
+			},
+		}).RunWrite(session)
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusBadRequest, "Error to store invite")
+			return
+		}
+
+		if writeInfo.Unchanged == 1 {
+			writeError(w, http.StatusConflict, "User already invited")
+			return
+		}
+
+		notify(session, hub, to, "invite", invite)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(invite)
+	}))).Methods("POST")
+
+	route.HandleFunc("/users/me/invites", sm.Middleware(chat.RequireScope(chat.ScopeRoomsRead, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		var userID string = chat.UserIDFrom(r.Context())
+
+		invites := make(map[string][]chat.Invite)
+		for key, index := range map[string]string{"incoming": "to", "outgoing": "from"} {
+			cursor, err := re.DB("chat").Table("invites").GetAllByIndex(index, userID).Filter(
+				re.Row.Field("expires").Gt(chat.UTCNow()),
+			).OrderBy("created").Run(session)
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			list := make([]chat.Invite, 0)
+			if err = cursor.All(&list); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			invites[key] = list
+		}
+		json.NewEncoder(w).Encode(invites)
+	}))).Methods("GET")
+
+	//Accepting makes the user a member of the room
+	route.HandleFunc("/invites/{inviteID}/accept", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		var userID string = chat.UserIDFrom(r.Context())
+
+		invite, found := takeInvite(session, w, mux.Vars(r)["inviteID"], userID)
+		if !found {
+			return
+		}
+
+		//A user banned after the invite can not accept it
+		var current chat.RoomInfo
+		if findRoom(session, invite.RoomID, &current) && current.IsBanned(userID) {
+			writeError(w, http.StatusForbidden, "Banned from the room")
+			return
+		}
+
+		writeInfo, err := re.DB("chat").Table("rooms").Get(invite.RoomID).Update(map[string]interface{}{
+			"members": re.Row.Field("members").Default([]string{}).SetInsert(userID),
+		}, re.UpdateOpts{ReturnChanges: "always"}).RunWrite(session)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		//The room was deleted after the invite
+		if writeInfo.Skipped == 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		room := writeInfo.Changes[0].NewValue.(map[string]interface{})
+
+		notify(session, hub, invite.From, "invite_accepted", map[string]interface{}{
+			"id":     invite.ID,
+			"roomID": invite.RoomID,
+			"userID": userID,
+		})
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"roomID": invite.RoomID,
+			"name":   room["name"],
+			"join":   "/rooms/" + invite.RoomID + "/join",
+		})
+	}))).Methods("POST")
+
+	route.HandleFunc("/invites/{inviteID}/decline", sm.Middleware(chat.RequireScope(chat.ScopeRoomsWrite, func(w http.ResponseWriter, r *http.Request) {
+		var userID string = chat.UserIDFrom(r.Context())
+
+		invite, found := takeInvite(session, w, mux.Vars(r)["inviteID"], userID)
+		if !found {
+			return
+		}
+
+		notify(session, hub, invite.From, "invite_declined", map[string]interface{}{
+			"id":     invite.ID,
+			"roomID": invite.RoomID,
+			"userID": userID,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("POST")
+
+	/*** JOIN HUB ***/
+	route.HandleFunc("/hub/join", sm.SocketMiddleware(chat.RequireScope(chat.ScopeHubSubscribe, func(w http.ResponseWriter, r *http.Request) {
+		var userID string = chat.UserIDFrom(r.Context())
+
+		conn, err := websocket.Accept(w, r, chat.AcceptOptions(r))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer conn.Close(websocket.StatusInternalError, "Connection closed")
+
+		ctx, close := context.WithCancel(context.Background())
+		defer close()
+
+		data := make(map[string]interface{})
+
+		//Connected to HUB
+		peer := chat.SocketPeer(conn)
+		hub.AddFlush(userID, peer, func() error {
+			return flushNotifications(ctx, session, userID, peer)
+		})
+		go func() {
+			if err := chat.Heartbeat(ctx, conn, *wsPing, *wsTimeout); err != nil {
+				log.Printf("Hub heartbeat failed: %s %v\n", userID, err)
+				close()
+			}
+		}()
+		for {
+			if err = wsjson.Read(ctx, conn, &data); err != nil {
+				hub.Rem(userID, peer)
+				log.Printf("Disconnected from hub: %s\n", userID)
+				return
+			}
+
+			switch data["event"] {
+			case "set_status":
+				status, _ := data["status"].(string)
+				if err = hub.SetStatus(userID, status); err != nil {
+					log.Println(err)
+				}
+			case "ack":
+				id, _ := data["id"].(string)
+				if err = re.DB("chat").Table("notifications").GetAll(id).Filter(
+					re.Row.Field("userID").Eq(userID),
+				).Delete().Exec(session); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	})))
+
+	route.HandleFunc("/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+
+		info := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+
+		var user chat.User
+		var found bool
+		var ipKey string = concatStr("ip:", remoteIP(r))
+		var accountKey string
+		if name, ok := info["name"].(string); ok {
+			//Login with name and password
+			accountKey = concatStr("account:", chat.NameKey(name))
+			if !allowLogin(limiter, w, ipKey, accountKey) {
+				return
+			}
+			password, _ := info["password"].(string)
+			found = findUserByPassword(session, name, password, &user)
+		} else {
+			//Login with secret key, a key without key ID is a legacy one
+			key, _ := info["user"].(string)
+			if keyID, _, err := chat.ParseSecretKey(key); err == nil {
+				accountKey = concatStr("key:", keyID)
+			} else if len(key) > 0 {
+				accountKey = concatStr("key:", chat.LegacyKeyID(key))
+			}
+
+			//Without a key only the IP is limited
+			keys := []string{ipKey}
+			if len(accountKey) > 0 {
+				keys = append(keys, accountKey)
+			}
+			if !allowLogin(limiter, w, keys...) {
+				return
+			}
+			found = len(key) > 0 && findUserByKey(session, key, &user)
+		}
+
+		if !found {
+			if len(accountKey) > 0 {
+				failLogin(limiter, ipKey, accountKey)
+			} else {
+				failLogin(limiter, ipKey)
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		passLogin(limiter, ipKey, accountKey)
+
+		if user.Suspended {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		token := sm.Store(time.Minute*15, user.UserID, user.Role)
+		re.DB("chat").Table("users").Get(user.ID).Update(map[string]interface{}{
+			"lasttime": time.Now().Format(time.RFC3339),
+		}).Exec(session)
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"session": token,
+			"user":    user,
+		})
+
+	}).Methods("POST")
+
+	//Ticket to open a WebSocket, browsers cannot send the Authorization header
+	route.HandleFunc("/auth/ws-ticket", sm.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		auth, _ := chat.SessionFrom(r.Context())
+
+		ticket := sm.Ticket(time.Second*30, auth, chat.SocketTicket)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ticket":  ticket,
+			"expires": 30,
+		})
+	})).Methods("POST")
+
+	//Recover an account with name, a recovery code and a new password
+	route.HandleFunc("/auth/recover", func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+
+		info := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !validPassword(info["newPassword"]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var ipKey string = concatStr("ip:", remoteIP(r))
+		var accountKey string = concatStr("account:", chat.NameKey(info["name"]))
+		if !allowLogin(limiter, w, ipKey, accountKey) {
+			return
+		}
+
+		//Errors that are no failed attempt give the reservation back
+		var settled bool
+		defer func() {
+			if !settled {
+				limiter.Release(ipKey)
+				limiter.Release(accountKey)
+			}
+		}()
+
+		cursor, err := re.DB("chat").Table("users").GetAllByIndex("nameKey", chat.NameKey(info["name"])).Filter(re.Row.HasFields("passwordHash")).Run(session)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var user chat.User
+		if err = cursor.One(&user); err != nil {
+			settled = true
+			failLogin(limiter, ipKey, accountKey)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		index := chat.MatchRecoveryCode(user.RecoveryHashes, info["code"])
+		if index < 0 {
+			settled = true
+			failLogin(limiter, ipKey, accountKey)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		settled = true
+		passLogin(limiter, ipKey, accountKey)
+
+		passHash, err := chat.HashSecret(info["newPassword"])
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		//Each code is used once, only the first request using it wins
+		var used string = user.RecoveryHashes[index]
+		writeInfo, err := re.DB("chat").Table("users").Get(user.ID).Update(re.Branch(
+			re.Row.Field("recoveryHashes").Contains(used),
+			map[string]interface{}{
+				"passwordHash":   passHash,
+				"recoveryHashes": re.Row.Field("recoveryHashes").SetDifference([]string{used}),
+			},
+			map[string]interface{}{},
+		)).RunWrite(session)
+
+		if err != nil || writeInfo.Replaced != 1 {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"remainingCodes": len(user.RecoveryHashes) - 1,
+		})
+	}).Methods("POST")
+
+	route.HandleFunc("/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+
+		var userInfo chat.User
+		if err := json.NewDecoder(r.Body).Decode(&userInfo); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err := re.DB("chat").Table("session").Filter(re.Row.Field("user").Eq(userInfo.ID)).Delete().Exec(session)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}).Methods("POST")
+
+	//Create User
+	route.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+
+		var userData chat.User
+		if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !validName(userData.Name) {
+			log.Println("Name not valid")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		keyID, secret, key := chat.NewSecretKey()
+		secretHash, err := chat.HashSecret(secret)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		userData.Created = time.Now().Format(time.RFC3339)
+		newUser := map[string]interface{}{
+			"name":       userData.Name,
+			"nameKey":    chat.NameKey(userData.Name),
+			"created":    userData.Created,
+			"keyID":      keyID,
+			"secretHash": secretHash,
+			"friends":    []string{},
+		}
+
+		//Password is optional, it allows login with name
+		if len(userData.Password) > 0 {
+			if !validPassword(userData.Password) {
+				log.Println("Password not valid")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if newUser["passwordHash"], err = chat.HashSecret(userData.Password); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			userData.Recovery = chat.NewRecoveryCodes(8)
+			if newUser["recoveryHashes"], err = chat.HashRecoveryCodes(userData.Recovery); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			userData.Password = ""
+		}
+
+		res, err := re.DB("chat").Table("users").Insert(newUser).RunWrite(session)
+
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		userData.UserID = chat.EncodeToSha(concatStr(res.GeneratedKeys[0], userData.Name, userData.Created))
+		userData.SecretKey = key
+
+		if !reserveName(session, userData.Name, userData.UserID) {
+			re.DB("chat").Table("users").Get(res.GeneratedKeys[0]).Delete().Exec(session)
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		re.DB("chat").Table("users").Get(res.GeneratedKeys[0]).Update(map[string]interface{}{
+			"userID": userData.UserID,
+		}).Exec(session)
+
+		userData.ID = ""
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(&userData); err != nil {
+			log.Println(err)
+		}
+	}).Methods("POST")
+
+	//Search users by name prefix, "next" is the cursor of the next page
+	route.HandleFunc("/users", sm.Optional(func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		query := r.URL.Query()
+
+		//Users blocked by who is searching are hidden
+		var me chat.User
+		if userID := chat.UserIDFrom(r.Context()); len(userID) > 0 {
+			findUserByID(session, userID, &me)
+		}
+		hidden := append(make([]string, 0), me.Blocked...)
+
+		var prefix string = chat.NameKey(query.Get("q"))
+		var after string = query.Get("cursor")
+		if len(after) > 0 && !strings.HasPrefix(after, prefix) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 20
+		} else if limit > 100 {
+			limit = 100
+		}
+
+		//Names are ASCII, so every name with the prefix is before prefix+"\x7f"
+		between := re.BetweenOpts{Index: "nameKey", LeftBound: "closed"}
+		var lower string = prefix
+		if len(after) > 0 {
+			lower = after
+			between.LeftBound = "open"
+		}
+
+		cursor, err := re.DB("chat").Table("users").Between(lower, prefix+"\x7f", between).OrderBy(
+			re.OrderByOpts{Index: "nameKey"},
+		).Filter(func(user re.Term) interface{} {
+			return re.Expr(hidden).Contains(user.Field("userID")).Not()
+		}).Limit(limit + 1).Run(session)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		users := make([]chat.User, 0)
+		var next, last string
+		var user chat.User
+		for cursor.Next(&user) {
+			//One more than the limit means there is a next page
+			if len(users) == limit {
+				next = last
+				break
+			}
+			users = append(users, user.Public())
+			last = user.NameKey
+			user = chat.User{}
+		}
+		cursor.Close()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"users": users,
+			"next":  next,
+		})
+	})).Methods("GET")
+
+	//Set a new password, the current one is required if there is one
+	route.HandleFunc("/users/me/password", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+		var userID string = chat.UserIDFrom(r.Context())
+
+		info := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !validPassword(info["newPassword"]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		cursor, err := re.DB("chat").Table("users").Filter(re.Row.Field("userID").Eq(userID)).Run(session)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var user chat.User
+		if err = cursor.One(&user); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if len(user.PassHash) > 0 && !chat.CompareSecret(user.PassHash, info["password"]) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		passHash, err := chat.HashSecret(info["newPassword"])
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		update := map[string]interface{}{
+			"passwordHash": passHash,
+		}
+
+		//First password also creates the recovery codes
+		var codes []string
+		if len(user.RecoveryHashes) == 0 {
+			codes = chat.NewRecoveryCodes(8)
+			if update["recoveryHashes"], err = chat.HashRecoveryCodes(codes); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err = re.DB("chat").Table("users").Get(user.ID).Update(update).Exec(session); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"recoveryCodes": codes,
+		})
+	}))).Methods("POST")
+
+	//Issue a new secret key, the old one stops working
+	route.HandleFunc("/users/me/rotate-key", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		var userID string = chat.UserIDFrom(r.Context())
+
+		keyID, secret, key := chat.NewSecretKey()
+		secretHash, err := chat.HashSecret(secret)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeInfo, err := re.DB("chat").Table("users").Filter(re.Row.Field("userID").Eq(userID)).Update(map[string]interface{}{
+			"keyID":      keyID,
+			"secretHash": secretHash,
+		}).RunWrite(session)
+
+		if err != nil || writeInfo.Replaced != 1 {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"secretKey": key,
+		})
+	}))).Methods("POST")
+
+	//Update name, status or avatar, missing fields are unchanged
+	route.HandleFunc("/users/me", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+		var userID string = chat.UserIDFrom(r.Context())
+
+		info := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var user chat.User
+		if !findUserByID(session, userID, &user) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		update := make(map[string]interface{})
+		if name, ok := info["name"].(string); ok && name != user.Name {
+			if !validName(name) {
+				log.Println("Name not valid")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			update["name"] = name
+			update["nameKey"] = chat.NameKey(name)
+		}
+
+		if status, ok := info["status"].(string); ok {
+			if utf8.RuneCountInString(status) > 140 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			update["status"] = status
+			user.Status = status
+		}
+
+		//Avatar is the hash of an uploaded one, empty removes it
+		if avatar, ok := info["avatar"].(string); ok {
+			if _, exists := avatars.Path(avatar, chat.AvatarSizes[0]); len(avatar) > 0 && !exists {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			update["avatar"] = avatar
+			user.Avatar = avatar
+		}
+
+		//Friends can see the room where the user is
+		if shareRoom, ok := info["shareRoom"].(bool); ok {
+			update["shareRoom"] = shareRoom
+		}
+
+		//Changing only the case keeps the same reservation
+		name, rename := update["name"].(string)
+		rename = rename && chat.NameKey(name) != user.NameKey
+		if rename && !reserveName(session, name, userID) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		if len(update) > 0 {
+			if err := re.DB("chat").Table("users").Get(user.ID).Update(update).Exec(session); err != nil {
+				log.Println(err)
+				if rename {
+					releaseName(session, name, userID)
+				}
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		if rename {
+			releaseName(session, user.Name, userID)
+		}
+		if len(name) > 0 {
+			user.Name = name
+		}
+
+		user = user.Public()
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&user)
+	}))).Methods("PATCH")
+
+	route.HandleFunc("/users/me", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		var userID string = chat.UserIDFrom(r.Context())
+
+		found, err := deleteUser(session, rooms, userID)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		sm.Revoke(userID)
+		hub.Close(userID, "Account deleted")
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("DELETE")
+
+	/*** AVATARS ***/
+	route.HandleFunc("/users/me/avatar", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+		var userID string = chat.UserIDFrom(r.Context())
+
+		hash, err := avatars.Save(http.MaxBytesReader(w, r.Body, chat.MaxAvatarBytes+1))
+		switch err {
+		case nil:
+		case chat.ErrAvatarFormat:
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		case chat.ErrAvatarSize:
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err = re.DB("chat").Table("users").GetAllByIndex("userID", userID).Update(map[string]interface{}{
+			"avatar": hash,
+		}).Exec(session); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"avatar": hash,
+		})
+	}))).Methods("PUT")
+
+	//Avatars never change, they are named by their content
+	route.HandleFunc("/avatars/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		parms := mux.Vars(r)
+
+		var size int = chat.AvatarSizes[0]
+		if query := r.URL.Query().Get("size"); len(query) > 0 {
+			size, _ = strconv.Atoi(query)
+		}
+
+		path, ok := avatars.Path(parms["hash"], size)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", fmt.Sprintf("\"%s-%d\"", parms["hash"], size))
+		http.ServeContent(w, r, "", time.Time{}, file)
+	}).Methods("GET")
+
+	/*** API TOKENS ***/
+	route.HandleFunc("/users/me/tokens", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+		var userID string = chat.UserIDFrom(r.Context())
+
+		var info chat.Token
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if len(info.Name) == 0 || len(info.Name) > 64 || !chat.ValidScopes(info.Scopes) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		id, secret, value := chat.NewToken()
+		token := chat.Token{
+			ID:      id,
+			UserID:  userID,
+			Name:    info.Name,
+			Scopes:  info.Scopes,
+			Hash:    chat.EncodeToSha(secret),
+			Created: time.Now().Format(time.RFC3339),
+		}
+
+		if err := re.DB("chat").Table("tokens").Insert(token).Exec(session); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		//The token is only shown once
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token": value,
+			"info":  token,
+		})
+	}))).Methods("POST")
+
+	route.HandleFunc("/users/me/tokens", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		var userID string = chat.UserIDFrom(r.Context())
+
+		cursor, err := re.DB("chat").Table("tokens").GetAllByIndex("userID", userID).Run(session)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		tokens := make([]chat.Token, 0)
+		if err = cursor.All(&tokens); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(tokens)
+	}))).Methods("GET")
+
+	route.HandleFunc("/users/me/tokens/{tokenID}", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		var userID string = chat.UserIDFrom(r.Context())
+		parms := mux.Vars(r)
+
+		//Only the owner revokes a token
+		writeInfo, err := re.DB("chat").Table("tokens").GetAllByIndex("userID", userID).Filter(
+			re.Row.Field("id").Eq(parms["tokenID"]),
+		).Delete().RunWrite(session)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if writeInfo.Deleted == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("DELETE")
+
+	/*** FRIENDS ***/
+	route.HandleFunc("/users/me/friends", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		var userID string = chat.UserIDFrom(r.Context())
+
+		var me chat.User
+		if !findUserByID(session, userID, &me) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		friends := make([]chat.User, 0, len(me.Friends))
+		if len(me.Friends) > 0 {
+			keys := make([]interface{}, len(me.Friends))
+			for i, id := range me.Friends {
+				keys[i] = id
+			}
+
+			cursor, err := re.DB("chat").Table("users").GetAllByIndex("userID", keys...).Run(session)
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			users := make([]chat.User, 0)
+			if err = cursor.All(&users); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			for _, user := range users {
+				friend := user.Public()
+				friend.Presence = hub.Presence(user.UserID)
+				if user.ShareRoom {
+					friend.Room, _ = rooms.Find(user.UserID)
+				}
+				friends = append(friends, friend)
+			}
+		}
 
-	//Create room
-	route.HandleFunc("/rooms", sm.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		chat.SortByPresence(friends)
+		json.NewEncoder(w).Encode(friends)
+	}))).Methods("GET")
+
+	route.HandleFunc("/users/me/friends/requests", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
 		setHeaderJSON(w)
 		defer r.Body.Close()
-		var userID string = r.Header.Get("userID")
+		var userID string = chat.UserIDFrom(r.Context())
 
-		data := make(map[string]interface{})
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			log.Println(err)
+		info := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil || info["to"] == userID {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		result, err := re.DB("chat").Table("rooms").Insert(map[string]interface{}{
-			"name":  data["roomName"],
-			"peers": []string{},
-			"owner": userID,
-		}).RunWrite(session)
+		var user, to chat.User
+		if !findUserByID(session, userID, &user) || !findUserByID(session, info["to"], &to) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest)
+		for _, friend := range user.Friends {
+			if friend == to.UserID {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		}
+
+		for _, blocked := range to.Blocked {
+			if blocked == userID {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		//Both want to be friends, accept the other request
+		writeInfo, err := re.DB("chat").Table("friendRequests").Get(chat.FriendRequestID(to.UserID, userID)).Delete().RunWrite(session)
+		if err == nil && writeInfo.Deleted == 1 {
+			if err = setFriends(session, userID, to.UserID, true); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			notify(session, hub, to.UserID, "friend_accepted", map[string]interface{}{
+				"userID": userID,
+			})
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		request := chat.FriendRequest{
+			ID:      chat.FriendRequestID(userID, to.UserID),
+			From:    userID,
+			To:      to.UserID,
+			Created: time.Now().Format(time.RFC3339),
+		}
+
+		if _, err = re.DB("chat").Table("friendRequests").Insert(request).RunWrite(session); err != nil {
+			w.WriteHeader(http.StatusConflict)
 			return
 		}
 
+		notify(session, hub, to.UserID, "friend_request", request)
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"roomID": result.GeneratedKeys[0],
-		})
-	})).Methods("POST")
+		json.NewEncoder(w).Encode(request)
+	}))).Methods("POST")
 
-	/* Room Get Info */
-	route.HandleFunc("/rooms/{roomID}", func(w http.ResponseWriter, r *http.Request) {
+	route.HandleFunc("/users/me/friends/requests", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
 		setHeaderJSON(w)
-		defer r.Body.Close()
+		var userID string = chat.UserIDFrom(r.Context())
+
+		requests := make(map[string][]chat.FriendRequest)
+		for key, index := range map[string]string{"incoming": "to", "outgoing": "from"} {
+			cursor, err := re.DB("chat").Table("friendRequests").GetAllByIndex(index, userID).OrderBy("created").Run(session)
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			list := make([]chat.FriendRequest, 0)
+			if err = cursor.All(&list); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			requests[key] = list
+		}
+		json.NewEncoder(w).Encode(requests)
+	}))).Methods("GET")
 
+	route.HandleFunc("/friends/requests/{requestID}/accept", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		var userID string = chat.UserIDFrom(r.Context())
 		parms := mux.Vars(r)
 
-		cursor, err := re.DB("chat").Table("rooms").Get(parms["roomID"]).Run(session)
+		//Only the recipient accepts
+		writeInfo, err := re.DB("chat").Table("friendRequests").GetAll(parms["requestID"]).Filter(
+			re.Row.Field("to").Eq(userID),
+		).Delete(re.DeleteOpts{ReturnChanges: true}).RunWrite(session)
 		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		if cursor.IsNil() {
-			log.Println(err)
-			w.WriteHeader(http.StatusNoContent)
+		if writeInfo.Deleted == 0 {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		var roomInfo chat.RoomInfo
-		if err = cursor.One(&roomInfo); err != nil {
+		var from string = writeInfo.Changes[0].OldValue.(map[string]interface{})["from"].(string)
+		if err = setFriends(session, userID, from, true); err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
+		notify(session, hub, from, "friend_accepted", map[string]interface{}{
+			"userID": userID,
+		})
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(roomInfo)
-	}).Methods("GET")
+	}))).Methods("POST")
 
-	route.HandleFunc("/invite", sm.Middleware(func(w http.ResponseWriter, r *http.Request) {
-		setHeaderJSON(w)
-		var userID string = r.Header.Get("userID")
+	//Decline is done by the recipient, cancel by the sender
+	route.HandleFunc("/friends/requests/{requestID}/decline", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		deleteFriendRequest(session, w, mux.Vars(r)["requestID"], "to", chat.UserIDFrom(r.Context()))
+	}))).Methods("POST")
 
-		resp := make(map[string]interface{})
-		if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	route.HandleFunc("/friends/requests/{requestID}", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		deleteFriendRequest(session, w, mux.Vars(r)["requestID"], "from", chat.UserIDFrom(r.Context()))
+	}))).Methods("DELETE")
 
-		if userID == resp["to"] {
+	/*** BLOCKS ***/
+	//Blocking also ends the friendship and the pending requests
+	route.HandleFunc("/users/me/blocks", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var userID string = chat.UserIDFrom(r.Context())
+
+		info := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil || info["user"] == userID {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		inviteInfo := map[string]interface{}{
-			"roomID": resp["roomID"],
-			"from":   userID,
+		var blocked chat.User
+		if !findUserByID(session, info["user"], &blocked) {
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
 
-		err := re.DB("chat").Table("users").Filter(re.Row.Field("userID").Eq(resp["to"])).Update(
-			map[string]interface{}{
-				"invites": re.Row.Field("invites").Append(inviteInfo),
-			}).Exec(session)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		if err := re.DB("chat").Table("users").GetAllByIndex("userID", userID).Update(map[string]interface{}{
+			"blocked": re.Row.Field("blocked").Default([]string{}).SetInsert(blocked.UserID),
+		}).Exec(session); err != nil {
 			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		hub.WriteTo(ctx, "invite", inviteInfo, resp["to"].(string))
-		w.WriteHeader(http.StatusCreated)
-	})).Methods("POST")
-
-	/*** JOIN HUB ***/
-	route.HandleFunc("/hub/join", sm.Middleware(func(w http.ResponseWriter, r *http.Request) {
-		var userID string = r.Header.Get("userID")
-
-		conn, err := websocket.Accept(w, r, nil)
-		if err != nil {
+		if err := setFriends(session, userID, blocked.UserID, false); err != nil {
 			log.Println(err)
-			return
 		}
-		defer conn.Close(websocket.StatusInternalError, "Connection closed")
+		re.DB("chat").Table("friendRequests").GetAll(
+			chat.FriendRequestID(userID, blocked.UserID),
+			chat.FriendRequestID(blocked.UserID, userID),
+		).Delete().Exec(session)
 
-		ctx, close := context.WithCancel(context.Background())
-		defer close()
+		w.WriteHeader(http.StatusCreated)
+	}))).Methods("POST")
 
-		data := make(map[string]interface{})
-		if err = wsjson.Read(ctx, conn, &data); err != nil {
-			log.Println(err)
-			conn.Close(websocket.StatusInternalError, "Websocket read error")
+	route.HandleFunc("/users/me/blocks", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		var userID string = chat.UserIDFrom(r.Context())
+
+		var me chat.User
+		if !findUserByID(session, userID, &me) {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		//Connected to HUB
-		hub.Add(userID, conn)
-		for {
-			if err = wsjson.Read(ctx, conn, &data); err != nil {
-				hub.Rem(userID)
-				log.Printf("Disconnected from hub: %s\n", userID)
-				return
+		users := make([]chat.User, 0)
+		for _, blockedID := range me.Blocked {
+			var blocked chat.User
+			if findUserByID(session, blockedID, &blocked) {
+				users = append(users, blocked.Public())
 			}
 		}
-	}))
-
-	route.HandleFunc("/auth/login", func(w http.ResponseWriter, r *http.Request) {
-		setHeaderJSON(w)
-		defer r.Body.Close()
+		json.NewEncoder(w).Encode(users)
+	}))).Methods("GET")
 
-		info := make(map[string]interface{})
-		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			log.Println(err)
-			return
-		}
+	route.HandleFunc("/users/me/blocks/{userID}", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		var userID string = chat.UserIDFrom(r.Context())
+		parms := mux.Vars(r)
 
-		cursor, err := re.DB("chat").Table("users").Filter(re.Row.Field("secretKey").Eq(info["user"])).Run(session)
+		writeInfo, err := re.DB("chat").Table("users").GetAllByIndex("userID", userID).Update(map[string]interface{}{
+			"blocked": re.Row.Field("blocked").Default([]string{}).SetDifference([]string{parms["userID"]}),
+		}).RunWrite(session)
 		if err != nil {
+			log.Println(err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		if cursor.IsNil() {
-			w.WriteHeader(http.StatusBadRequest)
+		if writeInfo.Replaced == 0 {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("DELETE")
 
-		var user chat.User
-		if err = cursor.One(&user); err != nil {
+	route.HandleFunc("/users/me/friends/{userID}", sm.Middleware(chat.RequireScope(chat.ScopeAccount, func(w http.ResponseWriter, r *http.Request) {
+		var userID string = chat.UserIDFrom(r.Context())
+		parms := mux.Vars(r)
+
+		if err := setFriends(session, userID, parms["userID"], false); err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("DELETE")
 
-		token := sm.Store(time.Minute*15, user.UserID)
-		re.DB("chat").Table("users").Get(user.ID).Update(map[string]interface{}{
-			"lasttime": time.Now().Format(time.RFC3339),
-		}).Exec(session)
+	route.HandleFunc("/users/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		parms := mux.Vars(r)
 
-		user.SecretKey = ""
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"session": token,
-			"user":    user,
-		})
+		if userID, ok := parms["userID"]; ok {
+			cursor, err := re.DB("chat").Table("users").Filter(re.Row.Field("userID").Eq(userID)).Run(session)
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 
-	}).Methods("POST")
+			var user chat.User
+			if err = cursor.One(&user); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 
-	route.HandleFunc("/auth/logout", func(w http.ResponseWriter, r *http.Request) {
-		setHeaderJSON(w)
-		defer r.Body.Close()
+			//Hide some fields
+			user = user.Public()
+			user.Presence = hub.Presence(userID)
 
-		var userInfo chat.User
-		if err := json.NewDecoder(r.Body).Decode(&userInfo); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			if err = json.NewEncoder(w).Encode(&user); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 			return
 		}
+		w.WriteHeader(http.StatusBadRequest)
+	}).Methods("GET")
 
-		err := re.DB("chat").Table("session").Filter(re.Row.Field("user").Eq(userInfo.ID)).Delete().Exec(session)
+	/*** ADMIN ***/
+	route.HandleFunc("/admin/users", sm.RequireRole(chat.RoleModerator, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+
+		cursor, err := re.DB("chat").Table("users").Run(session)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
 			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		w.WriteHeader(http.StatusCreated)
-	}).Methods("POST")
 
-	//Create a chain publicKeys
-	lastPublicKey := make(chan string, 1)
-	lastPublicKey <- chat.EncodeToSha(concatStr(time.Now().Add(time.Millisecond * time.Duration(rand.Int())).Format(time.RFC3339)))
+		users := make([]chat.User, 0)
+		var user chat.User
+		for cursor.Next(&user) {
+			users = append(users, user)
+			user = chat.User{}
+		}
+		json.NewEncoder(w).Encode(users)
+	})).Methods("GET")
 
-	//Create User
-	route.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+	//Suspend or unsuspend a user, only users with a lower role
+	route.HandleFunc("/admin/users/{userID}/suspend", sm.RequireRole(chat.RoleModerator, func(w http.ResponseWriter, r *http.Request) {
 		setHeaderJSON(w)
+		defer r.Body.Close()
+		auth, _ := chat.SessionFrom(r.Context())
+		parms := mux.Vars(r)
 
-		var userData chat.User
-		if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
-			log.Print(err)
+		info := make(map[string]bool)
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		if len(userData.Name) < 4 || len(userData.Name) > 10 {
-			log.Println("Name not valid")
-			w.WriteHeader(http.StatusBadRequest)
+		var target chat.User
+		if !findUserByID(session, parms["userID"], &target) {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		matched, _ := regexp.Match("^([$][A-Za-z]|([a-zA-Z]))([_.]?[a-zA-Z0-9])*$", []byte(userData.Name))
-		if !matched {
-			log.Println("Name not valid")
-			w.WriteHeader(http.StatusBadRequest)
+		if !chat.Outranks(auth.Role, target.Role) {
+			w.WriteHeader(http.StatusForbidden)
 			return
 		}
 
-		userData.Created = time.Now().Format(time.RFC3339)
-		res, err := re.DB("chat").Table("users").Insert(map[string]interface{}{
-			"name":    userData.Name,
-			"created": userData.Created,
-			"invites": []string{},
-			"friends": []string{},
-		}).RunWrite(session)
-
-		if err != nil {
+		if err := re.DB("chat").Table("users").Get(target.ID).Update(map[string]interface{}{
+			"suspended": info["suspended"],
+		}).Exec(session); err != nil {
 			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
 
-		userData.UserID = chat.EncodeToSha(concatStr(res.GeneratedKeys[0], userData.Name, userData.Created))
-		userData.SecretKey = chat.EncodeToSha(concatStr(userData.UserID, <-lastPublicKey))
-		lastPublicKey <- userData.UserID
+		if info["suspended"] {
+			sm.Revoke(target.UserID)
+			hub.Close(target.UserID, "Suspended")
+		}
+		log.Printf("User '%s' suspended=%v by '%s'\n", target.UserID, info["suspended"], auth.UserID)
+		w.WriteHeader(http.StatusOK)
+	})).Methods("POST")
 
-		re.DB("chat").Table("users").Get(res.GeneratedKeys[0]).Update(map[string]interface{}{
-			"userID":    userData.UserID,
-			"secretKey": userData.SecretKey,
-		}).Exec(session)
+	//Change the role of a user, the new role is used from the next login
+	route.HandleFunc("/admin/users/{userID}/role", sm.RequireRole(chat.RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		setHeaderJSON(w)
+		defer r.Body.Close()
+		auth, _ := chat.SessionFrom(r.Context())
+		parms := mux.Vars(r)
 
-		userData.ID = ""
-		w.WriteHeader(http.StatusCreated)
-		if err := json.NewEncoder(w).Encode(&userData); err != nil {
-			log.Println(err)
+		info := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil || !chat.ValidRole(info["role"]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-	}).Methods("POST")
 
-	route.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
-		cursor, err := re.DB("chat").Table("users").Filter(re.Row.Field("id").Fill()).Run(session)
-		if err != nil {
+		var target chat.User
+		if !findUserByID(session, parms["userID"], &target) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		//Admins can not change their own role or other admins, one admin always remains
+		if target.UserID == auth.UserID || !chat.Outranks(auth.Role, target.Role) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if err := re.DB("chat").Table("users").Get(target.ID).Update(map[string]interface{}{
+			"role": info["role"],
+		}).Exec(session); err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		var users []chat.User
-		var user chat.User
-		for cursor.Next(&user) {
-			users = append(users, user)
-		}
-		json.NewEncoder(w).Encode(users)
-	}).Methods("GET")
+		sm.Revoke(parms["userID"])
+		log.Printf("User '%s' role=%s by '%s'\n", parms["userID"], info["role"], auth.UserID)
+		w.WriteHeader(http.StatusOK)
+	})).Methods("POST")
 
-	route.HandleFunc("/users/{userID}/addfriend", sm.Middleware(func(w http.ResponseWriter, r *http.Request) {
-		var userID string = r.Header.Get("userID")
-		defer r.Body.Close()
+	route.HandleFunc("/admin/users/{userID}", sm.RequireRole(chat.RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		auth, _ := chat.SessionFrom(r.Context())
+		parms := mux.Vars(r)
 
-		info := make(map[string]interface{})
-		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		var target chat.User
+		if !findUserByID(session, parms["userID"], &target) {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		writeInfo, err := re.DB("chat").Table("users").Filter(re.Row.Field("userID").Eq(userID)).Update(map[string]interface{}{
-			"friends": re.Row.Field("friends").SetInsert(info["user"]),
-		}).RunWrite(session)
+		if target.UserID == auth.UserID || !chat.Outranks(auth.Role, target.Role) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 
+		found, err := deleteUser(session, rooms, parms["userID"])
 		if err != nil {
+			log.Println(err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		if writeInfo.Unchanged == 1 {
-			w.WriteHeader(http.StatusNotModified)
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
-	})).Methods("POST")
+		sm.Revoke(parms["userID"])
+		hub.Close(parms["userID"], "Deleted")
+		log.Printf("User '%s' deleted by '%s'\n", parms["userID"], auth.UserID)
+		w.WriteHeader(http.StatusNoContent)
+	})).Methods("DELETE")
 
-	route.HandleFunc("/users/{userID}", func(w http.ResponseWriter, r *http.Request) {
+	route.HandleFunc("/admin/rooms/{roomID}", sm.RequireRole(chat.RoleModerator, func(w http.ResponseWriter, r *http.Request) {
+		auth, _ := chat.SessionFrom(r.Context())
 		parms := mux.Vars(r)
 
-		if userID, ok := parms["userID"]; ok {
-			cursor, err := re.DB("chat").Table("users").Filter(re.Row.Field("userID").Eq(userID)).Run(session)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			var user chat.User
-			if err = cursor.One(&user); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			//Hide some fields
-			user.SecretKey = ""
-			user.Invites = nil
+		writeInfo, err := re.DB("chat").Table("rooms").Get(parms["roomID"]).Delete().RunWrite(session)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-			if err = json.NewEncoder(w).Encode(&user); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
+		if writeInfo.Deleted == 0 {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		w.WriteHeader(http.StatusBadRequest)
-	}).Methods("GET")
+
+		re.DB("chat").Table("links").GetAllByIndex("roomID", parms["roomID"]).Delete().Exec(session)
+		rooms.Close(parms["roomID"], "Room closed")
+		log.Printf("Room '%s' closed by '%s'\n", parms["roomID"], auth.UserID)
+		w.WriteHeader(http.StatusNoContent)
+	})).Methods("DELETE")
 
 	//Handler for IMAGES
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("userID")
 		url := r.URL.Path
 		if len(url) >= 4 {
 			switch url[len(url)-4:] {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -86,6 +87,85 @@ func TestCreateUser(t *testing.T) {
 	createUser(nickname, t)
 }
 
+func TestPasswordLogin(t *testing.T) {
+	var buffer bytes.Buffer
+	var nickname string = genRandNickname()
+	json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"name":     nickname,
+		"password": "correct horse",
+	})
+
+	resp, err := http.Post("http://localhost:8080/users", "application/json", &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("Error to create user")
+	}
+
+	var user chat.User
+	if err = json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(user.Recovery) == 0 {
+		t.Fatal("Missing recovery codes")
+	}
+
+	json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"name":     nickname,
+		"password": "correct horse",
+	})
+
+	resp, err = http.Post("http://localhost:8080/auth/login", "application/json", &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("Error to login with password")
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	var nickname string = genRandNickname()
+	createUser(nickname, t)
+
+	var buffer bytes.Buffer
+	json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"name": strings.ToUpper(nickname),
+	})
+
+	resp, err := http.Post("http://localhost:8080/users", "application/json", &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatal("Name must be unique")
+	}
+
+	resp, err = http.Get("http://localhost:8080/users?q=" + nickname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var page struct {
+		Users []chat.User `json:"users"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Users) != 1 || page.Users[0].Name != nickname {
+		t.Fatal("Error to search user")
+	}
+}
+
 func TestSendInviteRoom(t *testing.T) {
 	users := make(chan chat.User, 2)
 
@@ -108,31 +188,26 @@ func TestSendInviteRoom(t *testing.T) {
 		session <- loginUser(from.SecretKey, t0)
 	})
 
-	var buffer bytes.Buffer
-	invite := map[string]interface{}{
-		"to":     to.UserID,
-		"roomID": "",
-	}
+	var token string = <-session
+	var roomID string = createRoom(token, "room101", t)
 
-	if err := json.NewEncoder(&buffer).Encode(invite); err != nil {
-		t.Fatal(err)
+	sendInvite := func(roomID string) int {
+		return request("POST", "/invite", token, map[string]interface{}{
+			"to":     to.UserID,
+			"roomID": roomID,
+		}, nil, t)
 	}
 
-	req, err := http.NewRequest("POST", "http://localhost:8080/invite", &buffer)
-	if err != nil {
-		t.Fatal(err)
+	if sendInvite("") != http.StatusNotFound {
+		t.Fatal("Invite to a room that not exists")
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", <-session)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		t.Fatal(err)
+	if sendInvite(roomID) != http.StatusCreated {
+		t.Fatal("Error to send invite")
 	}
 
-	if resp.StatusCode != http.StatusCreated {
-		t.Fail()
+	if sendInvite(roomID) != http.StatusConflict {
+		t.Fatal("Invite sent twice")
 	}
 }
 
@@ -147,16 +222,36 @@ func TestCreateRoom(t *testing.T) {
 		session <- loginUser((<-user).SecretKey, t0)
 	})
 
-	var roomID string = createRoom(<-session, "room101", t)
+	var token string = <-session
+	data := make(map[string]interface{})
+	if request("POST", "/rooms", token, map[string]interface{}{
+		"roomName":   "room101",
+		"visibility": "private",
+	}, &data, t) != http.StatusCreated {
+		t.Fatal("Error to create room")
+	}
+	roomID := data["roomID"].(string)
 
-	resp, err := http.Get("http://localhost:8080/rooms/" + roomID)
-	if err != nil {
-		t.Fatal(err)
+	//Room info needs a session
+	if request("GET", "/rooms/"+roomID, "", nil, nil, t) == http.StatusOK {
+		t.Fatal("Room info without session")
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if request("GET", "/rooms/"+roomID, token, nil, nil, t) != http.StatusOK {
 		t.Fail()
 	}
+
+	//The room is private to others
+	other := createUser(genRandNickname(), t)
+	if request("GET", "/rooms/"+roomID, loginUser(other.SecretKey, t), nil, nil, t) != http.StatusForbidden {
+		t.Fatal("Private room info shown to others")
+	}
+
+	//Rooms are public by default
+	publicID := createRoom(token, "room102", t)
+	if request("GET", "/rooms/"+publicID, loginUser(other.SecretKey, t), nil, nil, t) != http.StatusOK {
+		t.Fatal("Public room info hidden from others")
+	}
 }
 
 func TestJoinHub(t *testing.T) {
@@ -215,6 +310,297 @@ func TestJoinRoom(t *testing.T) {
 	})
 }
 
+func TestDeleteUser(t *testing.T) {
+	var user chat.User = createUser(genRandNickname(), t)
+	var token string = loginUser(user.SecretKey, t)
+	roomID := createRoom(token, "room101", t)
+
+	if request("DELETE", "/users/me", token, nil, nil, t) != http.StatusNoContent {
+		t.Fatal("Error to delete user")
+	}
+
+	//A room without admins goes with its owner
+	var other chat.User = createUser(genRandNickname(), t)
+	if request("GET", "/rooms/"+roomID, loginUser(other.SecretKey, t), nil, nil, t) != http.StatusNoContent {
+		t.Fatal("Room of the deleted user still exists")
+	}
+
+	resp, err := http.Get("http://localhost:8080/users/" + user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("Deleted user still exists")
+	}
+}
+
+func TestFriendRequest(t *testing.T) {
+	var from chat.User = createUser(genRandNickname(), t)
+	var to chat.User = createUser(genRandNickname(), t)
+	var fromToken string = loginUser(from.SecretKey, t)
+	var toToken string = loginUser(to.SecretKey, t)
+
+	var friendRequest chat.FriendRequest
+	if request("POST", "/users/me/friends/requests", fromToken, map[string]interface{}{
+		"to": to.UserID,
+	}, &friendRequest, t) != http.StatusCreated {
+		t.Fatal("Error to send friend request")
+	}
+
+	if request("POST", "/friends/requests/"+friendRequest.ID+"/accept", toToken, nil, nil, t) != http.StatusOK {
+		t.Fatal("Error to accept friend request")
+	}
+}
+
+func TestAcceptInvite(t *testing.T) {
+	var from chat.User = createUser(genRandNickname(), t)
+	var to chat.User = createUser(genRandNickname(), t)
+	var fromToken string = loginUser(from.SecretKey, t)
+	var toToken string = loginUser(to.SecretKey, t)
+	var roomID string = createRoom(fromToken, "room101", t)
+
+	var invite chat.Invite
+	if request("POST", "/invite", fromToken, map[string]interface{}{
+		"to":     to.UserID,
+		"roomID": roomID,
+	}, &invite, t) != http.StatusCreated {
+		t.Fatal("Error to send invite")
+	}
+
+	join := make(map[string]interface{})
+	if request("POST", "/invites/"+invite.ID+"/accept", toToken, nil, &join, t) != http.StatusOK {
+		t.Fatal("Error to accept invite")
+	}
+
+	if join["roomID"] != roomID {
+		t.Fatal("Error to join the invited room")
+	}
+
+	//An invite is accepted only once
+	if request("POST", "/invites/"+invite.ID+"/accept", toToken, nil, nil, t) != http.StatusNotFound {
+		t.Fatal("Invite accepted twice")
+	}
+}
+
+func TestRoomLink(t *testing.T) {
+	var owner chat.User = createUser(genRandNickname(), t)
+	var ownerToken string = loginUser(owner.SecretKey, t)
+	var roomID string = createRoom(ownerToken, "room101", t)
+
+	var link chat.RoomLink
+	if request("POST", "/rooms/"+roomID+"/links", ownerToken, map[string]interface{}{
+		"maxUses": 1,
+	}, &link, t) != http.StatusCreated {
+		t.Fatal("Error to create link")
+	}
+
+	if request("GET", "/join/"+link.Token, "", nil, nil, t) != http.StatusOK {
+		t.Fatal("Error to resolve link")
+	}
+
+	redeem := func() int {
+		user := createUser(genRandNickname(), t)
+		return request("POST", "/join/"+link.Token, loginUser(user.SecretKey, t), nil, nil, t)
+	}
+
+	if redeem() != http.StatusOK {
+		t.Fatal("Error to redeem link")
+	}
+
+	if redeem() != http.StatusGone {
+		t.Fatal("Link used more than its max uses")
+	}
+}
+
+func TestLockedRoom(t *testing.T) {
+	var owner chat.User = createUser(genRandNickname(), t)
+	var ownerToken string = loginUser(owner.SecretKey, t)
+
+	data := make(map[string]interface{})
+	if request("POST", "/rooms", ownerToken, map[string]interface{}{
+		"roomName":   "room101",
+		"password":   "swordfish",
+		"visibility": "public",
+	}, &data, t) != http.StatusCreated {
+		t.Fatal("Error to create room")
+	}
+	roomID := data["roomID"].(string)
+
+	var user chat.User = createUser(genRandNickname(), t)
+	var token string = loginUser(user.SecretKey, t)
+
+	//The hash is never shown
+	info := make(map[string]interface{})
+	if request("GET", "/rooms/"+roomID, token, nil, &info, t) != http.StatusOK {
+		t.Fatal("Error to get room info")
+	}
+
+	if _, ok := info["Password"]; ok || info["Locked"] != true {
+		t.Fatalf("Wrong locked room info %v", info)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	header := make(http.Header)
+	header.Set("Authorization", token)
+	join := func(query string) (*websocket.Conn, int) {
+		conn, resp, err := websocket.Dial(ctx, "ws://localhost:8080/rooms/"+roomID+"/join"+query, &websocket.DialOptions{
+			HTTPHeader: header,
+		})
+		if resp == nil {
+			t.Fatal(err)
+		}
+
+		if err != nil {
+			return nil, resp.StatusCode
+		}
+		return conn, http.StatusSwitchingProtocols
+	}
+
+	if _, status := join(""); status != http.StatusForbidden {
+		t.Fatal("Locked room joined without a ticket")
+	}
+
+	unlock := func(password string, out interface{}) int {
+		return request("POST", "/rooms/"+roomID+"/unlock", token, map[string]interface{}{
+			"password": password,
+		}, out, t)
+	}
+
+	if unlock("gump", nil) != http.StatusForbidden {
+		t.Fatal("Room unlocked with a wrong password")
+	}
+
+	ticket := make(map[string]interface{})
+	if unlock("swordfish", &ticket) != http.StatusCreated {
+		t.Fatal("Error to unlock room")
+	}
+
+	conn, status := join("?roomTicket=" + ticket["roomTicket"].(string))
+	if status != http.StatusSwitchingProtocols {
+		t.Fatal("Error to join with a ticket")
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestRoomModeration(t *testing.T) {
+	var owner chat.User = createUser(genRandNickname(), t)
+	var ownerToken string = loginUser(owner.SecretKey, t)
+	roomID := createRoom(ownerToken, "room101", t)
+
+	var user chat.User = createUser(genRandNickname(), t)
+	var token string = loginUser(user.SecretKey, t)
+
+	do := func(method, path, token string, body map[string]interface{}) int {
+		return request(method, "/rooms/"+roomID+path, token, body, nil, t)
+	}
+
+	if do("POST", "/bans", token, map[string]interface{}{"user": owner.UserID}) != http.StatusForbidden {
+		t.Fatal("User banned the owner")
+	}
+
+	if do("POST", "/admins", ownerToken, map[string]interface{}{"user": user.UserID}) != http.StatusBadRequest {
+		t.Fatal("Owner promoted who is not a member")
+	}
+
+	if do("DELETE", "/admins/"+user.UserID, ownerToken, nil) != http.StatusBadRequest {
+		t.Fatal("Owner demoted who is not an admin")
+	}
+
+	if do("POST", "/kick", ownerToken, map[string]interface{}{"user": user.UserID}) != http.StatusNotFound {
+		t.Fatal("Kicked who is not in the room")
+	}
+
+	if do("POST", "/bans", ownerToken, map[string]interface{}{"user": user.UserID}) != http.StatusNoContent {
+		t.Fatal("Error to ban user")
+	}
+
+	if do("GET", "", token, nil) != http.StatusForbidden {
+		t.Fatal("Banned user sees the room")
+	}
+
+	if do("DELETE", "/bans/"+user.UserID, ownerToken, nil) != http.StatusNoContent {
+		t.Fatal("Error to unban user")
+	}
+
+	if do("DELETE", "/bans/"+user.UserID, ownerToken, nil) != http.StatusNotFound {
+		t.Fatal("Unbanned who is not banned")
+	}
+}
+
+func TestBlockedInRoom(t *testing.T) {
+	var owner chat.User = createUser(genRandNickname(), t)
+	var ownerToken string = loginUser(owner.SecretKey, t)
+	roomID := createRoom(ownerToken, "room101", t)
+
+	var user chat.User = createUser(genRandNickname(), t)
+	var token string = loginUser(user.SecretKey, t)
+
+	//Each one blocked the other
+	if request("POST", "/users/me/blocks", ownerToken, map[string]interface{}{"user": user.UserID}, nil, t) != http.StatusCreated {
+		t.Fatal("Error to block user")
+	}
+
+	if request("POST", "/users/me/blocks", token, map[string]interface{}{"user": owner.UserID}, nil, t) != http.StatusCreated {
+		t.Fatal("Error to block owner")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	join := func(token string) *websocket.Conn {
+		header := make(http.Header)
+		header.Set("Authorization", token)
+		conn, _, err := websocket.Dial(ctx, "ws://localhost:8080/rooms/"+roomID+"/join", &websocket.DialOptions{
+			HTTPHeader: header,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	//Skip the events until the expected one
+	expect := func(conn *websocket.Conn, event, userID string) {
+		for {
+			resp := make(map[string]interface{})
+			if err := wsjson.Read(ctx, conn, &resp); err != nil {
+				t.Fatalf("No %s event: %v", event, err)
+			}
+
+			if resp["event"] == event && resp["userID"] == userID {
+				return
+			}
+		}
+	}
+
+	ownerConn := join(ownerToken)
+	defer ownerConn.Close(websocket.StatusNormalClosure, "")
+
+	//The owner must be a peer before the user joins
+	for {
+		var info chat.RoomInfo
+		request("GET", "/rooms/"+roomID, ownerToken, nil, &info, t)
+		if info.IsConnected(owner.UserID) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("Owner never connected")
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+
+	conn := join(token)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	expect(conn, "blocked_user_in_room", owner.UserID)
+	expect(ownerConn, "blocked_user_joined", user.UserID)
+}
+
 func createRoom(token, roomName string, t *testing.T) string {
 	var buffer bytes.Buffer
 	json.NewEncoder(&buffer).Encode(map[string]interface{}{
@@ -246,6 +632,40 @@ func createRoom(token, roomName string, t *testing.T) string {
 	return data["roomID"].(string)
 }
 
+// request sends body as JSON with the session token and decodes a successful response in out
+// A nil body or out is skipped, it returns the status code
+func request(method, path, token string, body interface{}, out interface{}, t *testing.T) int {
+	var buffer bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buffer).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://localhost:8080"+path, &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(token) > 0 {
+		req.Header.Set("Authorization", token)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode < http.StatusMultipleChoices {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
 func genRandNickname() (nickname string) {
 	var r int = int('z') - int('a')
 	for i := 0; i < 8; i++ {
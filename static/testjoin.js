@@ -26,8 +26,26 @@ function createroom(name){
   return s.responseText;
 }
 
-function joinroom(roomid){
-  var ws = new WebSocket("ws:" + window.location.host + "/chat/rooms/" + roomid);
+// Browsers cannot set the Authorization header on a WebSocket,
+// so a single-use ticket is sent as subprotocol
+function wsTicket(session, callback){
+  var s = new XMLHttpRequest();
+  s.open("POST", "http://" + window.location.host + "/auth/ws-ticket");
+  s.setRequestHeader("Authorization", session);
+  s.send();
+  s.onload = function(e){
+    callback(JSON.parse(s.responseText).ticket);
+  }
+}
+
+function joinroom(roomid, session){
+  wsTicket(session, function(ticket){
+    connectroom(roomid, ticket);
+  });
+}
+
+function connectroom(roomid, ticket){
+  var ws = new WebSocket("ws://" + window.location.host + "/rooms/" + roomid + "/join", ["ticket." + ticket]);
   ws.onopen = function(){
     var rtc = new RTCPeerConnection({
       'servers': [
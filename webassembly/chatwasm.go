@@ -105,7 +105,7 @@ func join(roomID string) {
 	})
 }
 
-func post(url string, data map[string]interface{}, callback func(status int, response string)) {
+func post(url string, session string, data map[string]interface{}, callback func(status int, response string)) {
 	req := js.Global().Get("XMLHttpRequest").New(nil)
 
 	req.Set("onload", js.FuncOf(func(v js.Value, args []js.Value) interface{} {
@@ -114,6 +114,9 @@ func post(url string, data map[string]interface{}, callback func(status int, res
 	}))
 
 	req.Call("open", "POST", url)
+	if len(session) > 0 {
+		req.Call("setRequestHeader", "Authorization", session)
+	}
 	encode, err := json.Marshal(data)
 	if err != nil {
 		fmt.Printf("Post '%s'\n", url)
@@ -122,8 +125,34 @@ func post(url string, data map[string]interface{}, callback func(status int, res
 	req.Call("send", string(encode))
 }
 
+func get(url string, session string, callback func(status int, response string)) {
+	req := js.Global().Get("XMLHttpRequest").New(nil)
+
+	req.Set("onload", js.FuncOf(func(v js.Value, args []js.Value) interface{} {
+		callback(req.Get("status").Int(), req.Get("response").String())
+		return nil
+	}))
+
+	req.Call("open", "GET", url)
+	if len(session) > 0 {
+		req.Call("setRequestHeader", "Authorization", session)
+	}
+	req.Call("send")
+}
+
+// loadFriends renders the friend list in the sidebar
+func loadFriends(session string) {
+	get(concatURL("http", "/users/me/friends"), session, func(status int, response string) {
+		if status != http.StatusOK {
+			fmt.Printf("Friends status %d\n", status)
+			return
+		}
+		js.Global().Call("renderFriends", js.Global().Get("JSON").Call("parse", response))
+	})
+}
+
 func createUser(username string) {
-	post(concatURL("http", "/users"), map[string]interface{}{
+	post(concatURL("http", "/users"), "", map[string]interface{}{
 		"name": username,
 	}, func(status int, data string) {
 		if status == http.StatusCreated {
@@ -152,45 +181,80 @@ func sendMessage(message interface{}, to string) {
 
 }
 
-func connectHub(session, userID string) {
+// wsTicket gets a single-use ticket to open a WebSocket
+func wsTicket(session string, callback func(ticket string)) {
+	post(concatURL("http", "/auth/ws-ticket"), session, nil, func(status int, response string) {
+		if status != http.StatusCreated {
+			fmt.Printf("Ticket status %d\n", status)
+			return
+		}
+
+		resp := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(response), &resp); err != nil {
+			fmt.Println(err)
+			return
+		}
+		ticket, ok := resp["ticket"].(string)
+		if !ok {
+			fmt.Println("Ticket missing in response")
+			return
+		}
+		callback(ticket)
+	})
+}
+
+func connectHub(session string, ticket string) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	conn, _, err := websocket.Dial(ctx, concatURL("ws", "/hub"), nil)
+	conn, _, err := websocket.Dial(ctx, concatStr(concatURL("ws", "/hub/join"), "?ticket=", ticket), nil)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	defer conn.Close(websocket.StatusInternalError, "Connection closed")
 
-	if err := wsjson.Write(ctx, conn, map[string]interface{}{
-		"session": session,
-		"userID":  userID,
-	}); err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	data := make(map[string]interface{})
+	seen := make(map[string]bool)
 	for {
+		data := make(map[string]interface{})
 		if err = wsjson.Read(ctx, conn, &data); err != nil {
 			fmt.Println(err)
 			return
 		}
 
+		//Events with ID are sent again until acknowledged
+		id, durable := data["id"].(string)
+		if durable && seen[id] {
+			continue
+		}
+
 		switch data["event"] {
 		case "invite":
 			invite := data["message"].(map[string]interface{})
 			notifyInvite(invite["from"].(string), invite["roomID"].(string))
 			break
+		case "friend_request":
+			request := data["message"].(map[string]interface{})
+			js.Global().Call("alert", concatStr("You recv a friend request from ", request["from"].(string)))
+		case "presence", "friend_accepted":
+			loadFriends(session)
 		default:
-			conn.Close(websocket.StatusInternalError, "Error")
+			//Newer events are ignored
+			fmt.Printf("Event '%v'\n", data["event"])
+		}
+
+		if durable {
+			seen[id] = true
+			wsjson.Write(ctx, conn, map[string]interface{}{
+				"event": "ack",
+				"id":    id,
+			})
 		}
 	}
 }
 
 func loginUser(secretKey string) {
-	post(concatURL("http", "/auth/login"), map[string]interface{}{
+	post(concatURL("http", "/auth/login"), "", map[string]interface{}{
 		"secretKey": secretKey,
 	}, func(status int, response string) {
 		if status == http.StatusCreated {
@@ -201,10 +265,12 @@ func loginUser(secretKey string) {
 			}
 
 			session := resp["session"].(string)
-			userID := resp["user"].(map[string]interface{})["userID"].(string)
 
 			//Connect to hub
-			go connectHub(session, userID)
+			wsTicket(session, func(ticket string) {
+				go connectHub(session, ticket)
+			})
+			loadFriends(session)
 		}
 	})
 }